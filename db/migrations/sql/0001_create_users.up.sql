@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT UNIQUE NOT NULL PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	online BOOL DEFAULT false,
+	files TEXT[],
+	created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
+	updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
+);
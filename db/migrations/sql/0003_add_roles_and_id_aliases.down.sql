@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_id_aliases;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user';
+
+-- Legacy user_<n> IDs are kept here after being rewritten to UUIDv7.
+CREATE TABLE IF NOT EXISTS user_id_aliases (
+	legacy_id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE
+);
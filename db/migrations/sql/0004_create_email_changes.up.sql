@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT;
+
+CREATE TABLE IF NOT EXISTS email_changes (
+	id BIGSERIAL PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	old_email TEXT NOT NULL,
+	new_email TEXT NOT NULL,
+	confirm_token_hash TEXT UNIQUE NOT NULL,
+	undo_token_hash TEXT UNIQUE NOT NULL,
+	created BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now())),
+	confirm_expires BIGINT NOT NULL,
+	undo_expires BIGINT NOT NULL,
+	confirmed BIGINT,
+	cancelled BIGINT
+);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_requested BIGINT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS purge_after BIGINT;
+CREATE INDEX IF NOT EXISTS users_purge_after_idx ON users (purge_after) WHERE purge_after IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at BIGINT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at BIGINT;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_email_domain_idx;
+DROP INDEX IF EXISTS users_name_id_idx;
+DROP INDEX IF EXISTS users_updated_idx;
+DROP INDEX IF EXISTS users_created_idx;
@@ -0,0 +1,4 @@
+CREATE INDEX IF NOT EXISTS users_created_idx ON users (created, id);
+CREATE INDEX IF NOT EXISTS users_updated_idx ON users (updated, id);
+CREATE INDEX IF NOT EXISTS users_name_id_idx ON users (name, id);
+CREATE INDEX IF NOT EXISTS users_email_domain_idx ON users (lower(split_part(email, '@', 2)));
@@ -0,0 +1,9 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (
+		to_tsvector('simple', coalesce(name, '') || ' ' || regexp_replace(coalesce(email, ''), '[@.+_-]', ' ', 'g'))
+	) STORED;
+CREATE INDEX IF NOT EXISTS users_search_vector_idx ON users USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (lower(name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING GIN (lower(email) gin_trgm_ops);
@@ -0,0 +1,2 @@
+ALTER TABLE users RENAME COLUMN legacy_files TO files;
+DROP TABLE IF EXISTS files;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS files (
+	id TEXT PRIMARY KEY,
+	owner_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	sha256 TEXT NOT NULL,
+	storage_key TEXT UNIQUE NOT NULL,
+	created BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now()))
+);
+CREATE INDEX IF NOT EXISTS files_owner_idx ON files (owner_id, id);
+
+-- users.files held client-written strings with no stored contents, so they
+-- cannot become rows of the files table. They are kept as legacy_files and
+-- handed back in data exports; users.files is now derived from the table.
+ALTER TABLE users RENAME COLUMN files TO legacy_files;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS upload_parts;
+DROP TABLE IF EXISTS uploads;
@@ -0,0 +1,23 @@
+-- Resumable (tus) uploads. Each accepted chunk is a separate blob listed in
+-- upload_parts until the upload completes and they are joined into a file.
+CREATE TABLE IF NOT EXISTS uploads (
+	id TEXT PRIMARY KEY,
+	owner_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	length BIGINT NOT NULL,
+	upload_offset BIGINT NOT NULL DEFAULT 0,
+	sha256 TEXT,
+	file_id TEXT REFERENCES files(id) ON DELETE SET NULL,
+	created BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now())),
+	expires BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS uploads_expires_idx ON uploads (expires);
+
+CREATE TABLE IF NOT EXISTS upload_parts (
+	upload_id TEXT NOT NULL REFERENCES uploads(id) ON DELETE CASCADE,
+	part_offset BIGINT NOT NULL,
+	size BIGINT NOT NULL,
+	storage_key TEXT UNIQUE NOT NULL,
+	PRIMARY KEY (upload_id, part_offset)
+);
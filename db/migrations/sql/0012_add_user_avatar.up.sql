@@ -0,0 +1,3 @@
+-- avatar names the current avatar set, stored as blobs under
+-- avatars/<user id>/<avatar>/<size>.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar TEXT;
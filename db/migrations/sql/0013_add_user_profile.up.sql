@@ -0,0 +1,5 @@
+-- profile holds per-user settings validated against
+-- server/handlers/profile_schema.json. jsonb_path_ops indexes @> lookups,
+-- which is how the user list filters on profile keys.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS profile JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS users_profile_idx ON users USING GIN (profile jsonb_path_ops);
@@ -0,0 +1,9 @@
+-- Imported users without a password are sent an invite link to set one.
+CREATE TABLE IF NOT EXISTS user_invites (
+	token_hash TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now())),
+	expires BIGINT NOT NULL,
+	accepted BIGINT
+);
+CREATE INDEX IF NOT EXISTS user_invites_user_idx ON user_invites (user_id);
@@ -0,0 +1,22 @@
+-- Archives of everything held about a user, built in the background on
+-- request. status moves pending -> running -> ready or failed; the archive
+-- is kept in the BlobStore under storage_key until expires.
+CREATE TABLE IF NOT EXISTS data_exports (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	status TEXT NOT NULL DEFAULT 'pending',
+	storage_key TEXT UNIQUE,
+	size BIGINT,
+	sha256 TEXT,
+	error TEXT,
+	created BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now())),
+	started BIGINT,
+	completed BIGINT,
+	expires BIGINT
+);
+CREATE INDEX IF NOT EXISTS data_exports_user_idx ON data_exports (user_id, created);
+CREATE INDEX IF NOT EXISTS data_exports_status_idx ON data_exports (status, created);
+CREATE INDEX IF NOT EXISTS data_exports_expires_idx ON data_exports (expires);
+-- A user has at most one export waiting or being built.
+CREATE UNIQUE INDEX IF NOT EXISTS data_exports_active_idx ON data_exports (user_id)
+	WHERE status IN ('pending', 'running');
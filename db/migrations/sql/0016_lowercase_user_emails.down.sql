@@ -0,0 +1,2 @@
+-- The original casing of emails is not kept, so there is nothing to undo.
+SELECT 1;
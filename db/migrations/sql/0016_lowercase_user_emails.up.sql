@@ -0,0 +1,9 @@
+-- Emails are now stored lowercased and looked up as given. Existing addresses
+-- are lowercased unless that would collide with another account; those are
+-- left for an admin to resolve.
+UPDATE users SET email = lower(email)
+WHERE email <> lower(email)
+	AND lower(email) IN (SELECT lower(email) FROM users GROUP BY lower(email) HAVING count(*) = 1);
+
+UPDATE users SET pending_email = lower(pending_email)
+WHERE pending_email <> lower(pending_email);
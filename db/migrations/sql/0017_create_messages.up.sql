@@ -0,0 +1,15 @@
+-- Direct messages between two users. IDs are UUIDv7, so ordering by ID is
+-- ordering by send time.
+CREATE TABLE IF NOT EXISTS messages (
+	id TEXT PRIMARY KEY,
+	sender_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	recipient_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	body TEXT NOT NULL,
+	created BIGINT NOT NULL DEFAULT (EXTRACT(EPOCH FROM now()))
+);
+-- A conversation is the same whichever side sent a message.
+CREATE INDEX IF NOT EXISTS messages_conversation_idx
+	ON messages (LEAST(sender_id, recipient_id), GREATEST(sender_id, recipient_id), id);
+-- For deleting and exporting a user's messages.
+CREATE INDEX IF NOT EXISTS messages_sender_idx ON messages (sender_id);
+CREATE INDEX IF NOT EXISTS messages_recipient_idx ON messages (recipient_id);
@@ -0,0 +1,16 @@
+-- Emails are looked up case-insensitively. Accounts whose emails differ only
+-- in case, which migration 0016 left alone, cannot be told apart that way;
+-- they must be merged or renamed by hand before this migration can run.
+DO $$
+DECLARE
+	collisions TEXT;
+BEGIN
+	SELECT string_agg(email || ' (' || ids || ')', '; ') INTO collisions
+	FROM (SELECT lower(email) AS email, string_agg(id, ', ' ORDER BY id) AS ids
+		FROM users GROUP BY lower(email) HAVING count(*) > 1) colliding;
+	IF collisions IS NOT NULL THEN
+		RAISE EXCEPTION 'user emails differ only in case, resolve these accounts first: %', collisions;
+	END IF;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (lower(email));
@@ -0,0 +1,4 @@
+-- Sign-in sessions live in the memory of the server that issued them, so
+-- they are captured when an export is requested rather than by whichever
+-- server later builds it.
+ALTER TABLE data_exports ADD COLUMN IF NOT EXISTS sessions JSONB;
@@ -1,7 +1,18 @@
 package main
 
-import "rliterate-octo-waddle/server"
+import (
+	"os"
+	"rliterate-octo-waddle/server"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		runUsers(os.Args[2:])
+		return
+	}
 	server.StartAuthenticationServer()
 }
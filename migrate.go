@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"rliterate-octo-waddle/db"
+	"rliterate-octo-waddle/db/migrations"
+	"strconv"
+	"time"
+)
+
+// runMigrate implements the migrate subcommand:
+//
+//	migrate up          apply all pending migrations
+//	migrate down [n]    roll back the last n migrations (default 1)
+//	migrate status      list migrations and when they were applied
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate up | down [n] | status")
+	}
+
+	postgres, msg := db.ConnectPSQL()
+	if postgres == nil {
+		log.Fatal(msg)
+	}
+	defer postgres.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(ctx, postgres)
+		if err != nil {
+			log.Fatal("Error applying migrations:", err)
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatal("down takes a positive number of steps")
+			}
+			steps = n
+		}
+		rolledBack, err := migrations.Down(ctx, postgres, steps)
+		if err != nil {
+			log.Fatal("Error rolling back migrations:", err)
+		}
+		fmt.Printf("Rolled back %d migrations\n", rolledBack)
+	case "status":
+		statuses, err := migrations.List(ctx, postgres)
+		if err != nil {
+			log.Fatal("Error reading migration status:", err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + time.Unix(*s.AppliedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+	default:
+		log.Fatal("usage: migrate up | down [n] | status")
+	}
+}
@@ -0,0 +1,164 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ActionLogin          = "auth.login"
+	ActionRegister       = "auth.register"
+	ActionLogout         = "auth.logout"
+	ActionTokenRefresh   = "auth.refresh"
+	ActionTokenRejected  = "auth.token_rejected"
+	ActionPasswordChange = "user.password_change"
+	ActionUserUpdate     = "user.update"
+	ActionUserDelete     = "user.delete"
+	ActionUserIDMigrated = "user.id_migrated"
+
+	ActionEmailChangeRequest = "user.email_change_request"
+	ActionEmailChangeConfirm = "user.email_change_confirm"
+	ActionEmailChangeUndo    = "user.email_change_undo"
+	ActionInviteAccept       = "user.invite_accept"
+
+	ActionDeletionRequest = "user.deletion_request"
+	ActionDeletionRestore = "user.deletion_restore"
+	ActionUserPurge       = "user.purge"
+
+	ActionAdminDenied = "admin.access_denied"
+	ActionUserDisable = "admin.user_disable"
+	ActionUserEnable  = "admin.user_enable"
+	ActionUserRestore = "admin.user_restore"
+	ActionUserImport  = "admin.user_import"
+
+	ActionFileUpload = "file.upload"
+	ActionFileDelete = "file.delete"
+
+	ActionAvatarUpdate  = "user.avatar_update"
+	ActionAvatarDelete  = "user.avatar_delete"
+	ActionProfileUpdate = "user.profile_update"
+
+	ActionDataExportRequest  = "user.data_export_request"
+	ActionDataExportDownload = "user.data_export_download"
+
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type Event struct {
+	ID         int64          `json:"id"`
+	OccurredAt int64          `json:"occurred_at"`
+	ActorID    string         `json:"actor_id"`
+	TargetID   string         `json:"target_id"`
+	Action     string         `json:"action"`
+	IP         string         `json:"ip"`
+	UserAgent  string         `json:"user_agent"`
+	Outcome    string         `json:"outcome"`
+	Metadata   map[string]any `json:"metadata"`
+}
+
+// Record writes an event, filling in the client IP and user agent from the
+// request. Failures are logged rather than returned so that auditing never
+// changes the outcome of the request being audited.
+func Record(db *sql.DB, c *gin.Context, e Event) {
+	e.IP = c.ClientIP()
+	e.UserAgent = c.Request.UserAgent()
+	if e.Metadata == nil {
+		e.Metadata = map[string]any{}
+	}
+
+	metadata, err := json.Marshal(e.Metadata)
+	if err != nil {
+		fmt.Println("Failed to encode audit metadata:", err)
+		metadata = []byte("{}")
+	}
+
+	query := `INSERT INTO audit_events (actor_id, target_id, action, ip, user_agent, outcome, metadata)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = db.ExecContext(c, query, e.ActorID, e.TargetID, e.Action, e.IP, e.UserAgent, e.Outcome, metadata)
+	if err != nil {
+		fmt.Println("Failed to record audit event:", e.Action, err)
+	}
+}
+
+type Filter struct {
+	ActorID  string
+	TargetID string
+	// Involving matches events where the user is either actor or target.
+	Involving string
+	Action    string
+	Outcome   string
+	Since     int64
+	Until     int64
+	Before    int64
+	Limit     int
+}
+
+// List returns events matching the filter, newest first. Paging is keyset
+// based: pass the ID of the last event seen as Before to get the next page.
+func List(ctx context.Context, db *sql.DB, f Filter) ([]Event, error) {
+	var conditions []string
+	var args []any
+	add := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.ActorID != "" {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if f.Involving != "" {
+		add("(actor_id = $%[1]d OR target_id = $%[1]d)", f.Involving)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.Outcome != "" {
+		add("outcome = $%d", f.Outcome)
+	}
+	if f.Since > 0 {
+		add("occurred_at >= $%d", f.Since)
+	}
+	if f.Until > 0 {
+		add("occurred_at <= $%d", f.Until)
+	}
+	if f.Before > 0 {
+		add("id < $%d", f.Before)
+	}
+
+	query := `SELECT id, occurred_at, actor_id, target_id, action, ip, user_agent, outcome, metadata FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		var metadata []byte
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.ActorID, &e.TargetID, &e.Action, &e.IP, &e.UserAgent, &e.Outcome, &metadata); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
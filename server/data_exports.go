@@ -0,0 +1,31 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+	"rliterate-octo-waddle/server/handlers"
+	"rliterate-octo-waddle/server/storage"
+	"time"
+)
+
+// dataExportPollInterval is how often queued exports are looked for when
+// no request wakes the job, e.g. ones queued on another server.
+const dataExportPollInterval = time.Minute
+
+// runDataExportJob builds requested data exports in the background.
+func runDataExportJob(db *sql.DB, blobs storage.BlobStore) {
+	ticker := time.NewTicker(dataExportPollInterval)
+	defer ticker.Stop()
+	for {
+		built, err := handlers.ProcessDataExports(db, blobs)
+		if err != nil {
+			log.Println("[EXPORT] failed:", err)
+		} else if built > 0 {
+			log.Printf("[EXPORT] built %d data exports", built)
+		}
+		select {
+		case <-ticker.C:
+		case <-handlers.DataExportQueued():
+		}
+	}
+}
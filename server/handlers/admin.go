@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DisableUser suspends an account without losing its data. The user's
+// sessions and websocket connections are closed immediately.
+func DisableUser(db *sql.DB, c *gin.Context) {
+	query := `UPDATE users SET disabled_at = EXTRACT(EPOCH FROM now()), online = false, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $1 AND disabled_at IS NULL AND deleted_at IS NULL`
+	changeUserStatus(db, c, query, audit.ActionUserDisable, "User disabled!")
+}
+
+func EnableUser(db *sql.DB, c *gin.Context) {
+	query := `UPDATE users SET disabled_at = NULL, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $1 AND disabled_at IS NOT NULL AND deleted_at IS NULL`
+	changeUserStatus(db, c, query, audit.ActionUserEnable, "User enabled!")
+}
+
+// RestoreUser undoes a soft delete made through DeleteUserByID.
+func RestoreUser(db *sql.DB, c *gin.Context) {
+	query := `UPDATE users SET deleted_at = NULL, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $1 AND deleted_at IS NOT NULL`
+	changeUserStatus(db, c, query, audit.ActionUserRestore, "User restored!")
+}
+
+func changeUserStatus(db *sql.DB, c *gin.Context, query, action, message string) {
+	id := ResolveUserID(c, db, c.Param("id"))
+
+	result, err := db.ExecContext(c, query, id)
+	if err != nil {
+		fmt.Println("Status update failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		fmt.Println("Failed to retrieve rows affected:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	if rowsAffected == 0 {
+		var exists bool
+		if err := db.QueryRowContext(c, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, id).Scan(&exists); err != nil {
+			fmt.Println("Existence check failed:", err)
+			problem.AbortError(c, err)
+			return
+		}
+		if !exists {
+			problem.Abort(c, http.StatusNotFound, "User not found")
+			return
+		}
+		problem.Abort(c, http.StatusConflict, "User is not in a state that allows this change")
+		return
+	}
+
+	if action == audit.ActionUserDisable {
+		middleware.RevokeTokens(id)
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  c.GetString("userID"),
+		TargetID: id,
+		Action:   action,
+		Outcome:  audit.OutcomeSuccess,
+	})
+	fmt.Println(message, id)
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
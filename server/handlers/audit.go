@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/problem"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+func GetAuditEvents(db *sql.DB, c *gin.Context) {
+	filter := audit.Filter{
+		ActorID:  c.Query("actor"),
+		TargetID: c.Query("target"),
+		Action:   c.Query("action"),
+		Outcome:  c.Query("outcome"),
+		Limit:    defaultAuditPageSize,
+	}
+
+	ints := map[string]*int64{
+		"since":  &filter.Since,
+		"until":  &filter.Until,
+		"cursor": &filter.Before,
+	}
+	for name, dst := range ints {
+		raw := c.Query(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v < 0 {
+			problem.Abort(c, http.StatusBadRequest, fmt.Sprintf("Invalid %s parameter", name))
+			return
+		}
+		*dst = v
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			problem.Abort(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := audit.List(c, db, filter)
+	if err != nil {
+		fmt.Println("Audit query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	var nextCursor string
+	if len(events) == filter.Limit {
+		nextCursor = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":      events,
+		"next_cursor": nextCursor,
+	})
+}
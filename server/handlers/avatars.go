@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/ids"
+	"rliterate-octo-waddle/server/imaging"
+	"rliterate-octo-waddle/server/mailer"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxAvatarBytes    = 10 << 20
+	maxAvatarPixels   = 40_000_000
+	avatarJPEGQuality = 85
+)
+
+// AvatarSizes are the square thumbnail sizes rendered for every avatar. The
+// last one is served when no ?size= is given.
+var AvatarSizes = []int{64, 128, 256}
+
+// avatarURL is where anyone can fetch the avatar named by users.avatar.
+// Each upload gets a new name, so the URL changes with the picture.
+func avatarURL(userID string, avatar *string) string {
+	if avatar == nil {
+		return ""
+	}
+	return mailer.PublicURL() + "/avatars/" + userID + "/" + *avatar
+}
+
+// avatarKeys lists the blobs holding every size of an avatar.
+func avatarKeys(userID, avatar string) []string {
+	keys := make([]string, len(AvatarSizes))
+	for i, size := range AvatarSizes {
+		keys[i] = avatarKey(userID, avatar, size)
+	}
+	return keys
+}
+
+func avatarKey(userID, avatar string, size int) string {
+	return "avatars/" + userID + "/" + avatar + "/" + strconv.Itoa(size)
+}
+
+// deleteBlobs removes blobs that are no longer referenced. Failures are only
+// logged; the blobs are unreachable either way.
+func deleteBlobs(c *gin.Context, blobs storage.BlobStore, keys []string) {
+	for _, key := range keys {
+		if err := blobs.Delete(c, key); err != nil {
+			fmt.Println("Failed to remove blob:", key, err)
+		}
+	}
+}
+
+// UploadAvatar replaces the caller's avatar with the image in the multipart
+// form field "avatar". The type is sniffed rather than taken from the
+// request, and the image is re-encoded at each of AvatarSizes, which drops
+// any metadata the original carried.
+func UploadAvatar(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	callerID := c.GetString("userID")
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarBytes+1<<20)
+
+	header, err := c.FormFile("avatar")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || (err == nil && header.Size > maxAvatarBytes) {
+		problem.Abort(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Avatar must be at most %d bytes", maxAvatarBytes))
+		return
+	} else if err != nil {
+		problem.Abort(c, http.StatusBadRequest, "Multipart form field \"avatar\" is required")
+		return
+	}
+	src, err := header.Open()
+	if err != nil {
+		fmt.Println("Failed to open upload:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to read upload")
+		return
+	}
+	data, err := io.ReadAll(src)
+	src.Close()
+	if err != nil {
+		fmt.Println("Failed to read upload:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to read upload")
+		return
+	}
+
+	img, err := imaging.Decode(data, maxAvatarPixels)
+	if errors.Is(err, imaging.ErrUnsupported) {
+		problem.Abort(c, http.StatusUnsupportedMediaType, "Avatar must be a PNG, JPEG or WebP image")
+		return
+	} else if err != nil {
+		problem.Abort(c, http.StatusBadRequest, "Invalid image: "+err.Error())
+		return
+	}
+
+	id, err := ids.NewV7()
+	if err != nil {
+		fmt.Println("Error generating avatar ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate avatar ID")
+		return
+	}
+	// Opaque images are stored as JPEG and ones with transparency as PNG.
+	// The extension is part of the name, so serving needs no lookup.
+	avatar, contentType := id+".png", "image/png"
+	if imaging.Opaque(img.Image) {
+		avatar, contentType = id+".jpg", "image/jpeg"
+	}
+	var stored []string
+	for _, size := range AvatarSizes {
+		var buf bytes.Buffer
+		thumbnail := imaging.Thumbnail(img, size)
+		if contentType == "image/jpeg" {
+			err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: avatarJPEGQuality})
+		} else {
+			err = png.Encode(&buf, thumbnail)
+		}
+		if err == nil {
+			key := avatarKey(callerID, avatar, size)
+			err = blobs.Put(c, key, &buf, int64(buf.Len()), contentType)
+			stored = append(stored, key)
+		}
+		if err != nil {
+			fmt.Println("Avatar store failed:", err)
+			deleteBlobs(c, blobs, stored)
+			problem.Abort(c, http.StatusInternalServerError, "Failed to store avatar")
+			return
+		}
+	}
+
+	previous, err := setAvatar(db, c, callerID, &avatar)
+	if err != nil {
+		fmt.Println("Avatar update failed:", err)
+		deleteBlobs(c, blobs, stored)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to save avatar")
+		return
+	}
+	if previous != nil {
+		deleteBlobs(c, blobs, avatarKeys(callerID, *previous))
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  callerID,
+		TargetID: callerID,
+		Action:   audit.ActionAvatarUpdate,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"avatar": avatar, "type": img.ContentType},
+	})
+	fmt.Println("Avatar updated for user:", callerID)
+	c.JSON(http.StatusOK, gin.H{"avatar_url": avatarURL(callerID, &avatar)})
+}
+
+// setAvatar points the user at a new avatar, or none, and returns the one
+// it replaced.
+func setAvatar(db *sql.DB, c *gin.Context, userID string, avatar *string) (*string, error) {
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous *string
+	err = tx.QueryRowContext(c, `SELECT avatar FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&previous)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(c, `UPDATE users SET avatar = $2, updated = EXTRACT(EPOCH FROM now()) WHERE id = $1`, userID, avatar)
+	if err != nil {
+		return nil, err
+	}
+	return previous, tx.Commit()
+}
+
+// DeleteAvatar removes the caller's avatar.
+func DeleteAvatar(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	callerID := c.GetString("userID")
+	previous, err := setAvatar(db, c, callerID, nil)
+	if err != nil {
+		fmt.Println("Avatar delete failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if previous == nil {
+		problem.Abort(c, http.StatusNotFound, "No avatar set")
+		return
+	}
+	deleteBlobs(c, blobs, avatarKeys(callerID, *previous))
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  callerID,
+		TargetID: callerID,
+		Action:   audit.ActionAvatarDelete,
+		Outcome:  audit.OutcomeSuccess,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar deleted!"})
+}
+
+// GetAvatar serves an avatar to anyone holding its URL, so it can be used in
+// an <img> tag. Only a user's current avatar is served, and not once the
+// account is deleted. ?size= picks one of AvatarSizes.
+func GetAvatar(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	userID, avatar := c.Param("id"), c.Param("avatar")
+	size := AvatarSizes[len(AvatarSizes)-1]
+	if raw := c.Query("size"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || !slices.Contains(AvatarSizes, n) {
+			problem.Abort(c, http.StatusBadRequest, "size must be one of "+strings.Trim(fmt.Sprint(AvatarSizes), "[]"))
+			return
+		}
+		size = n
+	}
+
+	var exists bool
+	err := db.QueryRowContext(c, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND avatar = $2 AND deleted_at IS NULL)`, userID, avatar).
+		Scan(&exists)
+	if err == nil && !exists {
+		problem.Abort(c, http.StatusNotFound, "Avatar not found")
+		return
+	} else if err != nil {
+		fmt.Println("Avatar query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	body, err := blobs.Get(c, avatarKey(userID, avatar, size))
+	if errors.Is(err, storage.ErrNotFound) {
+		fmt.Println("Blob missing for avatar:", userID, avatar)
+		problem.Abort(c, http.StatusNotFound, "Avatar not found")
+		return
+	} else if err != nil {
+		fmt.Println("Avatar download failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to read avatar")
+		return
+	}
+	defer body.Close()
+
+	contentType := "image/png"
+	if strings.HasSuffix(avatar, ".jpg") {
+		contentType = "image/jpeg"
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, -1, contentType, body, nil)
+}
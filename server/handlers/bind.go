@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"rliterate-octo-waddle/server/problem"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// maxRequestBytes bounds JSON request bodies bound with bindJSON.
+const maxRequestBytes = 64 << 10
+
+// requestValidator checks the binding:"..." rules of request structs. Field
+// errors are reported under the field's JSON name.
+var requestValidator = func() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.SetTagName("binding")
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	v.RegisterValidation("maxbytes", func(fl validator.FieldLevel) bool {
+		n, err := strconv.Atoi(fl.Param())
+		return err == nil && len(fl.Field().String()) <= n
+	})
+	return v
+}()
+
+// normalizer is implemented by request bodies that tidy their fields, such
+// as trimming names and lowercasing emails, before they are validated.
+type normalizer interface {
+	normalize()
+}
+
+// bindJSON decodes the request body into req, normalizes it and checks its
+// binding rules. On failure it writes a problem and returns false.
+func bindJSON(c *gin.Context, req any) bool {
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestBytes)
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		problem.AbortWith(c, decodeProblem(err))
+		return false
+	}
+	if n, ok := req.(normalizer); ok {
+		n.normalize()
+	}
+	if fields := validateRequest(req); len(fields) > 0 {
+		problem.AbortWith(c, problem.Validation("The request body is invalid", fields...))
+		return false
+	}
+	return true
+}
+
+func decodeProblem(err error) *problem.Problem {
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return problem.Validation("The request body is invalid", problem.FieldError{
+			Field:   "/" + strings.ReplaceAll(typeErr.Field, ".", "/"),
+			Code:    "type",
+			Message: "must be " + jsonTypeName(typeErr.Type),
+		})
+	case errors.As(err, &tooLarge):
+		return problem.FromError(err)
+	case errors.Is(err, io.EOF):
+		return problem.New(http.StatusBadRequest, "Request body is empty")
+	}
+	return problem.New(http.StatusBadRequest, "Request body is not valid JSON")
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// validateRequest checks req's binding rules and returns one error per
+// failing field.
+func validateRequest(req any) []problem.FieldError {
+	var invalid validator.ValidationErrors
+	if err := requestValidator.Struct(req); !errors.As(err, &invalid) {
+		return nil
+	}
+	// Namespaces start with the struct's Go name, unless it is anonymous.
+	prefix := reflect.Indirect(reflect.ValueOf(req)).Type().Name() + "."
+	fields := make([]problem.FieldError, 0, len(invalid))
+	for _, fe := range invalid {
+		path := strings.TrimPrefix(fe.Namespace(), prefix)
+		fields = append(fields, problem.FieldError{
+			Field:   "/" + strings.ReplaceAll(path, ".", "/"),
+			Code:    fe.Tag(),
+			Message: ruleMessage(req, fe),
+		})
+	}
+	return fields
+}
+
+func ruleMessage(req any, fe validator.FieldError) string {
+	unit := ""
+	if fe.Kind() == reflect.String {
+		unit = " characters"
+	}
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "min":
+		return "must be at least " + fe.Param() + unit
+	case "max":
+		return "must be at most " + fe.Param() + unit
+	case "maxbytes":
+		return "must be at most " + fe.Param() + " bytes"
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "nefield":
+		return "must differ from " + jsonFieldName(req, fe.Param())
+	}
+	return fmt.Sprintf("is invalid (%s)", fe.Tag())
+}
+
+// jsonFieldName returns the JSON name of a top-level field of req, for rules
+// like nefield whose parameter is a Go field name.
+func jsonFieldName(req any, field string) string {
+	t := reflect.TypeOf(req)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if f, ok := t.FieldByName(field); ok {
+		if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" {
+			return name
+		}
+	}
+	return field
+}
+
+// normalizeEmail is applied to every email address a request carries, so
+// lookups by email need no case folding.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,552 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/ids"
+	"rliterate-octo-waddle/server/mailer"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	// dataExportRetention is how long a finished export can be downloaded.
+	dataExportRetention = 7 * 24 * time.Hour
+	// dataExportStaleAfter is when a running export is assumed to belong
+	// to a server that died, and is built again.
+	dataExportStaleAfter = time.Hour
+	dataExportURLExpiry  = 15 * time.Minute
+	dataExportAuditPage  = 500
+)
+
+// DataExport is a row of the data_exports table: an archive of everything
+// held about a user. DownloadURL is only set on ready exports.
+type DataExport struct {
+	ID          string  `json:"id"`
+	Status      string  `json:"status"`
+	Size        *int64  `json:"size,omitempty"`
+	Error       *string `json:"error,omitempty"`
+	Created     int64   `json:"created"`
+	Completed   *int64  `json:"completed,omitempty"`
+	Expires     *int64  `json:"expires,omitempty"`
+	DownloadURL string  `json:"download_url,omitempty"`
+	UserID      string  `json:"-"`
+	StorageKey  *string `json:"-"`
+	SHA256      *string `json:"-"`
+}
+
+const dataExportColumns = "id, user_id, status, storage_key, size, sha256, error, created, completed, expires"
+
+func scanDataExport(row rowScanner, e *DataExport) error {
+	return row.Scan(&e.ID, &e.UserID, &e.Status, &e.StorageKey, &e.Size, &e.SHA256, &e.Error, &e.Created, &e.Completed, &e.Expires)
+}
+
+// dataExportQueued wakes the export job when a new export is requested, so
+// it does not wait for its next tick.
+var dataExportQueued = make(chan struct{}, 1)
+
+// DataExportQueued is signalled whenever an export is requested.
+func DataExportQueued() <-chan struct{} {
+	return dataExportQueued
+}
+
+// withDownloadURL signs a short-lived download URL for a ready export. The
+// ID is namespaced so the signature can never be replayed against a file.
+func (e DataExport) withDownloadURL() DataExport {
+	if e.Status != "ready" {
+		return e
+	}
+	expires := time.Now().Add(dataExportURLExpiry).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", signFileURL("exports/"+e.ID, expires, "attachment", ""))
+	e.DownloadURL = mailer.PublicURL() + "/exports/" + url.PathEscape(e.ID) + "/download?" + query.Encode()
+	return e
+}
+
+func dataExportFileName(e DataExport) string {
+	return "data-export-" + time.Unix(*e.Completed, 0).UTC().Format("20060102") + ".zip"
+}
+
+// RequestDataExport queues an archive of everything held about the caller.
+// While one is waiting or being built, asking again returns that one.
+func RequestDataExport(db *sql.DB, c *gin.Context) {
+	callerID := c.GetString("userID")
+	id, err := ids.NewV7()
+	if err != nil {
+		fmt.Println("Error generating export ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate export ID")
+		return
+	}
+
+	// Sessions are held in this server's memory, not by the one that will
+	// build the archive, so they are captured now.
+	sessions, err := json.Marshal(middleware.Sessions(callerID))
+	if err != nil {
+		problem.AbortError(c, err)
+		return
+	}
+
+	_, err = db.ExecContext(c, `INSERT INTO data_exports (id, user_id, sessions) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'running') DO NOTHING`, id, callerID, sessions)
+	var export DataExport
+	if err == nil {
+		err = scanDataExport(db.QueryRowContext(c, `SELECT `+dataExportColumns+` FROM data_exports
+			WHERE user_id = $1 AND status IN ('pending', 'running')`, callerID), &export)
+	}
+	if err == sql.ErrNoRows {
+		// The export was claimed and finished between the two statements.
+		err = scanDataExport(db.QueryRowContext(c, `SELECT `+dataExportColumns+` FROM data_exports WHERE id = $1`, id), &export)
+	}
+	if err != nil {
+		fmt.Println("Failed to queue data export:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if export.ID == id {
+		audit.Record(db, c, audit.Event{
+			ActorID:  callerID,
+			TargetID: callerID,
+			Action:   audit.ActionDataExportRequest,
+			Outcome:  audit.OutcomeSuccess,
+			Metadata: map[string]any{"export_id": id},
+		})
+		select {
+		case dataExportQueued <- struct{}{}:
+		default:
+		}
+	}
+	c.Header("Location", "/api/users/me/exports/"+export.ID)
+	c.JSON(http.StatusAccepted, export.withDownloadURL())
+}
+
+// ListDataExports returns the caller's exports that have not expired,
+// newest first.
+func ListDataExports(db *sql.DB, c *gin.Context) {
+	rows, err := db.QueryContext(c, `SELECT `+dataExportColumns+` FROM data_exports
+		WHERE user_id = $1 AND (expires IS NULL OR expires > EXTRACT(EPOCH FROM now()))
+		ORDER BY created DESC, id DESC`, c.GetString("userID"))
+	if err != nil {
+		fmt.Println("Data export query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	exports := []DataExport{}
+	for rows.Next() {
+		var e DataExport
+		if err := scanDataExport(rows, &e); err != nil {
+			fmt.Println("Data export scan failed:", err)
+			problem.Abort(c, http.StatusInternalServerError, "Database error")
+			return
+		}
+		exports = append(exports, e.withDownloadURL())
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println("Data export query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"exports": exports})
+}
+
+// GetDataExport returns one of the caller's exports. Poll it until status
+// is ready, then fetch download_url.
+func GetDataExport(db *sql.DB, c *gin.Context) {
+	var export DataExport
+	err := scanDataExport(db.QueryRowContext(c, `SELECT `+dataExportColumns+` FROM data_exports
+		WHERE id = $1 AND user_id = $2 AND (expires IS NULL OR expires > EXTRACT(EPOCH FROM now()))`,
+		c.Param("id"), c.GetString("userID")), &export)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "Export not found")
+		return
+	} else if err != nil {
+		fmt.Println("Data export query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if export.Status == "pending" || export.Status == "running" {
+		c.Header("Retry-After", "5")
+	}
+	c.JSON(http.StatusOK, export.withDownloadURL())
+}
+
+// DownloadDataExport serves an archive named by a URL from GetDataExport.
+// Like DownloadSignedFile it sits outside JWTMiddleware.
+func DownloadDataExport(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	id := c.Param("id")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(c.Query("sig")), []byte(signFileURL("exports/"+id, expires, "attachment", ""))) {
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeInvalidSignature, "Invalid signature")
+		return
+	}
+	if expires <= time.Now().Unix() {
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeLinkExpired, "URL has expired")
+		return
+	}
+
+	var export DataExport
+	err = scanDataExport(db.QueryRowContext(c, `SELECT `+dataExportColumns+` FROM data_exports
+		WHERE id = $1 AND status = 'ready' AND expires > EXTRACT(EPOCH FROM now())`, id), &export)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "Export not found")
+		return
+	} else if err != nil {
+		fmt.Println("Data export query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	// Only the first request of a download is audited, not every range.
+	if c.GetHeader("Range") == "" {
+		audit.Record(db, c, audit.Event{
+			ActorID:  export.UserID,
+			TargetID: export.UserID,
+			Action:   audit.ActionDataExportDownload,
+			Outcome:  audit.OutcomeSuccess,
+			Metadata: map[string]any{"export_id": export.ID},
+		})
+	}
+	file := File{
+		ID:          export.ID,
+		OwnerID:     export.UserID,
+		ContentType: "application/zip",
+		Size:        *export.Size,
+		SHA256:      *export.SHA256,
+		Created:     *export.Completed,
+		StorageKey:  *export.StorageKey,
+	}
+	c.Header("Cache-Control", "private, no-store")
+	serveFileContent(blobs, c, file, "attachment", dataExportFileName(export))
+}
+
+// ProcessDataExports builds queued exports one at a time until none are
+// left, and returns how many it finished. Exports are claimed with SKIP
+// LOCKED, so several servers can run it at once.
+func ProcessDataExports(db *sql.DB, blobs storage.BlobStore) (int, error) {
+	ctx := context.Background()
+	done := 0
+	for {
+		var id, userID string
+		var sessions []byte
+		err := db.QueryRowContext(ctx, `UPDATE data_exports SET status = 'running', started = EXTRACT(EPOCH FROM now())
+			WHERE id = (SELECT id FROM data_exports
+				WHERE status = 'pending' OR (status = 'running' AND started < $1)
+				ORDER BY created LIMIT 1 FOR UPDATE SKIP LOCKED)
+			RETURNING id, user_id, sessions`, time.Now().Add(-dataExportStaleAfter).Unix()).Scan(&id, &userID, &sessions)
+		if err == sql.ErrNoRows {
+			return done, nil
+		} else if err != nil {
+			return done, err
+		}
+
+		if err := buildDataExport(ctx, db, blobs, id, userID, sessions); err != nil {
+			fmt.Println("Data export failed:", id, err)
+			_, err = db.ExecContext(ctx, `UPDATE data_exports SET status = 'failed', error = $2,
+				completed = EXTRACT(EPOCH FROM now()), expires = $3 WHERE id = $1`,
+				id, "The export could not be built, please request a new one", time.Now().Add(dataExportRetention).Unix())
+			if err != nil {
+				return done, err
+			}
+			continue
+		}
+		done++
+	}
+}
+
+// buildDataExport writes the archive to a temporary file, so its size is
+// known before it is stored, then marks the export ready and tells the user.
+// sessions is the JSON captured by RequestDataExport.
+func buildDataExport(ctx context.Context, db *sql.DB, blobs storage.BlobStore, id, userID string, sessions []byte) error {
+	tmp, err := os.CreateTemp("", "data-export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	email, err := writeDataExport(ctx, db, blobs, io.MultiWriter(tmp, hash), userID, sessions)
+	if err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	key := "exports/" + userID + "/" + id + ".zip"
+	if err := blobs.Put(ctx, key, tmp, size, "application/zip"); err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(dataExportRetention)
+	result, err := db.ExecContext(ctx, `UPDATE data_exports SET status = 'ready', storage_key = $2, size = $3, sha256 = $4,
+		completed = EXTRACT(EPOCH FROM now()), expires = $5 WHERE id = $1 AND status = 'running'`,
+		id, key, size, hex.EncodeToString(hash.Sum(nil)), expires.Unix())
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			// The account was purged while the archive was being built.
+			err = errors.New("export no longer exists")
+		}
+	}
+	if err != nil {
+		if deleteErr := blobs.Delete(ctx, key); deleteErr != nil {
+			fmt.Println("Failed to remove data export blob:", key, deleteErr)
+		}
+		return err
+	}
+
+	err = mailer.Send(email, "Your data export is ready",
+		"The archive of your account data you asked for is ready. Sign in to download it before "+
+			expires.UTC().Format("2 January 2006")+".\n")
+	if err != nil {
+		fmt.Println("Failed to send data export email:", err)
+	}
+	return nil
+}
+
+// dataExportReadme is the first entry of every archive.
+const dataExportReadme = `This archive holds everything stored about your account.
+
+user.json           your account, without the password hash, and the file
+                    entries saved before file uploads existed
+profile.json        your profile settings
+sessions.json       when the tokens of your active sign-in sessions were
+                    issued and expire, as of when you requested this archive
+email_changes.json  email address changes you requested
+audit_events.json   security events you performed or that concerned you
+files.json          metadata of your uploaded files
+files/              the files themselves, under their ID
+avatar/             your current avatar, if you have one
+messages.json       direct messages you sent or received
+
+Times are unix seconds.
+`
+
+// writeDataExport writes the zip archive for a user to w and returns the
+// user's email address. sessions is written as sessions.json; exports queued
+// before sessions were captured have none.
+func writeDataExport(ctx context.Context, db *sql.DB, blobs storage.BlobStore, w io.Writer, userID string, sessions []byte) (string, error) {
+	var user User
+	var profile []byte
+	var legacyFiles []string
+	err := scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+`, profile, legacy_files FROM users WHERE id = $1`, userID),
+		&user, &profile, pq.Array(&legacyFiles))
+	if err != nil {
+		return "", err
+	}
+	var legacyIDs []string
+	err = db.QueryRowContext(ctx, `SELECT ARRAY(SELECT legacy_id FROM user_id_aliases WHERE user_id = $1 ORDER BY legacy_id)`, userID).
+		Scan(pq.Array(&legacyIDs))
+	if err != nil {
+		return "", err
+	}
+
+	zw := zip.NewWriter(w)
+	writeJSON := func(name string, v any) error {
+		entry, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(entry)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	if entry, err := zw.Create("README.txt"); err != nil {
+		return "", err
+	} else if _, err := io.WriteString(entry, dataExportReadme); err != nil {
+		return "", err
+	}
+	account := struct {
+		AdminUser
+		LegacyIDs   []string `json:"legacy_ids,omitempty"`
+		LegacyFiles []string `json:"legacy_files,omitempty"`
+	}{adminView(user), legacyIDs, legacyFiles}
+	if err := writeJSON("user.json", account); err != nil {
+		return "", err
+	}
+	if err := writeJSON("profile.json", json.RawMessage(profile)); err != nil {
+		return "", err
+	}
+	if sessions == nil {
+		sessions = []byte("[]")
+	}
+	if err := writeJSON("sessions.json", json.RawMessage(sessions)); err != nil {
+		return "", err
+	}
+
+	emailChanges, err := exportEmailChanges(ctx, db, userID)
+	if err != nil {
+		return "", err
+	}
+	if err := writeJSON("email_changes.json", emailChanges); err != nil {
+		return "", err
+	}
+
+	events := []audit.Event{}
+	filter := audit.Filter{Involving: userID, Limit: dataExportAuditPage}
+	for {
+		page, err := audit.List(ctx, db, filter)
+		if err != nil {
+			return "", err
+		}
+		events = append(events, page...)
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.Before = page[len(page)-1].ID
+	}
+	if err := writeJSON("audit_events.json", events); err != nil {
+		return "", err
+	}
+
+	files, err := exportFiles(ctx, db, userID)
+	if err != nil {
+		return "", err
+	}
+	if err := writeJSON("files.json", files); err != nil {
+		return "", err
+	}
+	messages, err := exportMessages(ctx, db, userID)
+	if err != nil {
+		return "", err
+	}
+	if err := writeJSON("messages.json", messages); err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if err := copyBlob(ctx, zw, blobs, "files/"+f.ID+"/"+f.Name, f.StorageKey, time.Unix(f.Created, 0)); err != nil {
+			return "", err
+		}
+	}
+	if user.Avatar != nil {
+		key := avatarKey(userID, *user.Avatar, AvatarSizes[len(AvatarSizes)-1])
+		if err := copyBlob(ctx, zw, blobs, "avatar/"+*user.Avatar, key, time.Unix(user.Updated, 0)); err != nil {
+			return "", err
+		}
+	}
+	return user.Email, zw.Close()
+}
+
+// copyBlob adds a blob to the archive. Missing blobs are logged and left
+// out rather than failing the whole export.
+func copyBlob(ctx context.Context, zw *zip.Writer, blobs storage.BlobStore, name, key string, modified time.Time) error {
+	body, err := blobs.Get(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		fmt.Println("Blob missing from data export:", key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// Stored files are often already compressed, so they are not deflated
+	// again.
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, body)
+	return err
+}
+
+type exportedEmailChange struct {
+	OldEmail  string `json:"old_email"`
+	NewEmail  string `json:"new_email"`
+	Created   int64  `json:"created"`
+	Confirmed *int64 `json:"confirmed,omitempty"`
+	Cancelled *int64 `json:"cancelled,omitempty"`
+}
+
+func exportEmailChanges(ctx context.Context, db *sql.DB, userID string) ([]exportedEmailChange, error) {
+	rows, err := db.QueryContext(ctx, `SELECT old_email, new_email, created, confirmed, cancelled
+		FROM email_changes WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []exportedEmailChange{}
+	for rows.Next() {
+		var ch exportedEmailChange
+		if err := rows.Scan(&ch.OldEmail, &ch.NewEmail, &ch.Created, &ch.Confirmed, &ch.Cancelled); err != nil {
+			return nil, err
+		}
+		changes = append(changes, ch)
+	}
+	return changes, rows.Err()
+}
+
+func exportFiles(ctx context.Context, db *sql.DB, userID string) ([]File, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+fileColumns+` FROM files WHERE owner_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := []File{}
+	for rows.Next() {
+		var f File
+		if err := scanFile(rows, &f); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// ExpireDataExports removes exports past their expiry together with their
+// archives, and returns how many were removed.
+func ExpireDataExports(db *sql.DB, blobs storage.BlobStore) (int, error) {
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx, `DELETE FROM data_exports WHERE expires <= EXTRACT(EPOCH FROM now()) RETURNING storage_key`)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	expired := 0
+	for rows.Next() {
+		var key *string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired++
+		if key != nil {
+			keys = append(keys, *key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			fmt.Println("Failed to remove expired data export:", key, err)
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/mailer"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultDeletionGrace = 30 * 24 * time.Hour
+
+// DeletionGrace is how long a self-deleted account stays restorable before
+// it is purged, configured with ACCOUNT_DELETION_GRACE (e.g. "720h").
+func DeletionGrace() time.Duration {
+	raw := os.Getenv("ACCOUNT_DELETION_GRACE")
+	if raw == "" {
+		return defaultDeletionGrace
+	}
+	grace, err := time.ParseDuration(raw)
+	if err != nil || grace < 0 {
+		fmt.Println("Invalid ACCOUNT_DELETION_GRACE, using default:", raw)
+		return defaultDeletionGrace
+	}
+	return grace
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required,maxbytes=72"`
+}
+
+// RequestAccountDeletion disables the caller's account and schedules it for
+// purging once the grace period has passed. All sessions are revoked.
+func RequestAccountDeletion(db *sql.DB, c *gin.Context) {
+	var req DeleteAccountRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	userID := c.GetString("userID")
+
+	var email, storedHash string
+	err := db.QueryRowContext(c, `SELECT email, password FROM users WHERE id = $1`, userID).Scan(&email, &storedHash)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		fmt.Println("DB error fetching user:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if !CheckPasswordHash(req.Password, storedHash) {
+		audit.Record(db, c, audit.Event{
+			ActorID:  userID,
+			TargetID: userID,
+			Action:   audit.ActionDeletionRequest,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "bad_password"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Password is incorrect")
+		return
+	}
+
+	now := time.Now()
+	purgeAfter := now.Add(DeletionGrace())
+	_, err = db.ExecContext(c, `UPDATE users SET deletion_requested = $1, purge_after = $2, online = false,
+		updated = EXTRACT(EPOCH FROM now()) WHERE id = $3`, now.Unix(), purgeAfter.Unix(), userID)
+	if err != nil {
+		fmt.Println("Failed to schedule deletion:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	middleware.RevokeTokens(userID)
+
+	err = mailer.Send(email, "Your account is scheduled for deletion",
+		"Your account and its data will be permanently deleted after "+purgeAfter.UTC().Format(time.RFC1123)+".\n"+
+			"To keep your account, restore it before then at "+mailer.PublicURL()+"/auth/restore with your email and password.\n")
+	if err != nil {
+		fmt.Println("Failed to send deletion notice:", err)
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  userID,
+		TargetID: userID,
+		Action:   audit.ActionDeletionRequest,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"purge_after": purgeAfter.Unix()},
+	})
+	fmt.Println("Account deletion scheduled for user:", userID)
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":     "Account scheduled for deletion",
+		"purge_after": purgeAfter.Unix(),
+	})
+}
+
+// RestoreAccount cancels a pending self-deletion. It is an open route since
+// the account's tokens were revoked when deletion was requested.
+func RestoreAccount(db *sql.DB, c *gin.Context) {
+	var req LoginRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	var userID, storedHash string
+	var purgeAfter sql.NullInt64
+	err := db.QueryRowContext(c, `SELECT id, password, purge_after FROM users WHERE lower(email) = lower($1)`, req.Email).
+		Scan(&userID, &storedHash, &purgeAfter)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		fmt.Println("DB error fetching user:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if !CheckPasswordHash(req.Password, storedHash) {
+		audit.Record(db, c, audit.Event{
+			TargetID: userID,
+			Action:   audit.ActionDeletionRestore,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "bad_password"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Password Verification Failed")
+		return
+	}
+	if !purgeAfter.Valid {
+		problem.Abort(c, http.StatusConflict, "Account is not scheduled for deletion")
+		return
+	}
+
+	// The purge job runs only periodically, so an account past its grace
+	// period may still be here; it must not come back.
+	result, err := db.ExecContext(c, `UPDATE users SET deletion_requested = NULL, purge_after = NULL,
+		updated = EXTRACT(EPOCH FROM now()) WHERE id = $1 AND purge_after > EXTRACT(EPOCH FROM now())`, userID)
+	if err != nil {
+		fmt.Println("Failed to restore account:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		audit.Record(db, c, audit.Event{
+			TargetID: userID,
+			Action:   audit.ActionDeletionRestore,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "grace_period_ended", "purge_after": purgeAfter.Int64},
+		})
+		problem.AbortWith(c, problem.New(http.StatusGone, "The grace period has ended and the account can no longer be restored").
+			WithCode(problem.CodeGracePeriodEnded).
+			With("purge_after", purgeAfter.Int64))
+		return
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  userID,
+		TargetID: userID,
+		Action:   audit.ActionDeletionRestore,
+		Outcome:  audit.OutcomeSuccess,
+	})
+	fmt.Println("Account restored for user:", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Account restored, please log in again"})
+}
+
+// PurgeDeletedAccounts permanently removes accounts whose grace period has
+// ended. Rows in tables referencing users are removed by ON DELETE CASCADE
+// and the contents of their files, avatars and data exports are deleted
+// from blobs; audit events are kept.
+func PurgeDeletedAccounts(db *sql.DB, blobs storage.BlobStore) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT f.storage_key FROM files f JOIN users u ON u.id = f.owner_id
+		WHERE u.purge_after <= EXTRACT(EPOCH FROM now())
+		UNION ALL
+		SELECT p.storage_key FROM upload_parts p JOIN uploads up ON up.id = p.upload_id JOIN users u ON u.id = up.owner_id
+		WHERE u.purge_after <= EXTRACT(EPOCH FROM now())
+		UNION ALL
+		SELECT e.storage_key FROM data_exports e JOIN users u ON u.id = e.user_id
+		WHERE u.purge_after <= EXTRACT(EPOCH FROM now()) AND e.storage_key IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	var storageKeys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		storageKeys = append(storageKeys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows, err = tx.Query(`DELETE FROM users WHERE purge_after <= EXTRACT(EPOCH FROM now()) RETURNING id, avatar`)
+	if err != nil {
+		return 0, err
+	}
+	var purged []string
+	for rows.Next() {
+		var id string
+		var avatar *string
+		if err := rows.Scan(&id, &avatar); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		purged = append(purged, id)
+		if avatar != nil {
+			storageKeys = append(storageKeys, avatarKeys(id, *avatar)...)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range purged {
+		_, err := tx.Exec(`INSERT INTO audit_events (actor_id, target_id, action, outcome)
+			VALUES ('system', $1, $2, $3)`, id, audit.ActionUserPurge, audit.OutcomeSuccess)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range purged {
+		middleware.RevokeTokens(id)
+	}
+	for _, key := range storageKeys {
+		if err := blobs.Delete(context.Background(), key); err != nil {
+			fmt.Println("Failed to remove blob of purged account:", key, err)
+		}
+	}
+	return len(purged), nil
+}
@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/mailer"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	emailConfirmWindow = 24 * time.Hour
+	emailUndoWindow    = 7 * 24 * time.Hour
+)
+
+// newSecretToken returns a random URL-safe token and the hash that should be
+// stored in its place, so a database leak does not expose usable links.
+func newSecretToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, hashSecretToken(token), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type ChangeEmailRequest struct {
+	NewEmail string `json:"newEmail" binding:"required,email,max=254"`
+	Password string `json:"password" binding:"required,maxbytes=72"`
+}
+
+func (r *ChangeEmailRequest) normalize() {
+	r.NewEmail = normalizeEmail(r.NewEmail)
+}
+
+// RequestEmailChange records a pending email for the caller. The address is
+// only swapped once the link sent to the new address is followed; the old
+// address gets a notice with a link to cancel or revert the change.
+func RequestEmailChange(db *sql.DB, c *gin.Context) {
+	var req ChangeEmailRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	userID := c.GetString("userID")
+
+	var currentEmail, storedHash string
+	err := db.QueryRowContext(c, `SELECT email, password FROM users WHERE id = $1`, userID).Scan(&currentEmail, &storedHash)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		fmt.Println("DB error fetching user:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if !CheckPasswordHash(req.Password, storedHash) {
+		audit.Record(db, c, audit.Event{
+			ActorID:  userID,
+			TargetID: userID,
+			Action:   audit.ActionEmailChangeRequest,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "bad_password"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Password is incorrect")
+		return
+	}
+	if req.NewEmail == currentEmail {
+		problem.Abort(c, http.StatusBadRequest, "New email matches the current email")
+		return
+	}
+
+	var taken bool
+	err = db.QueryRowContext(c, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))`, req.NewEmail).Scan(&taken)
+	if err != nil {
+		fmt.Println("DB error checking email:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken {
+		problem.AbortCode(c, http.StatusConflict, problem.CodeAlreadyExists, "Email is already in use")
+		return
+	}
+
+	confirmToken, confirmHash, err := newSecretToken()
+	if err != nil {
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	undoToken, undoHash, err := newSecretToken()
+	if err != nil {
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		fmt.Println("Failed to begin transaction:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	// A new request supersedes any earlier one that was never confirmed.
+	now := time.Now()
+	_, err = tx.ExecContext(c, `UPDATE email_changes SET cancelled = $1
+		WHERE user_id = $2 AND confirmed IS NULL AND cancelled IS NULL`, now.Unix(), userID)
+	if err != nil {
+		fmt.Println("Failed to cancel previous email changes:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	_, err = tx.ExecContext(c, `INSERT INTO email_changes
+		(user_id, old_email, new_email, confirm_token_hash, undo_token_hash, confirm_expires, undo_expires)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		userID, currentEmail, req.NewEmail, confirmHash, undoHash,
+		now.Add(emailConfirmWindow).Unix(), now.Add(emailUndoWindow).Unix())
+	if err != nil {
+		fmt.Println("Failed to store email change:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	_, err = tx.ExecContext(c, `UPDATE users SET pending_email = $1, updated = EXTRACT(EPOCH FROM now()) WHERE id = $2`, req.NewEmail, userID)
+	if err != nil {
+		fmt.Println("Failed to set pending email:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	base := mailer.PublicURL()
+	confirmLink := base + "/auth/email/confirm?token=" + url.QueryEscape(confirmToken)
+	undoLink := base + "/auth/email/undo?token=" + url.QueryEscape(undoToken)
+
+	// The confirmation is sent before committing, so a change whose link
+	// never went out is rolled back rather than left pending.
+	err = mailer.Send(req.NewEmail, "Confirm your new email address",
+		"Follow this link within 24 hours to confirm your new email address:\n\n"+confirmLink+"\n")
+	if err != nil {
+		fmt.Println("Failed to send confirmation email:", err)
+		problem.Abort(c, http.StatusBadGateway, "Failed to send confirmation email, the change was not saved")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Failed to commit email change:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	err = mailer.Send(currentEmail, "Your email address is being changed",
+		"A change of the email address on your account to "+req.NewEmail+" was requested.\n"+
+			"If this was not you, follow this link within 7 days to cancel or revert it:\n\n"+undoLink+"\n")
+	if err != nil {
+		fmt.Println("Failed to send notice email:", err)
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  userID,
+		TargetID: userID,
+		Action:   audit.ActionEmailChangeRequest,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"old_email": currentEmail, "new_email": req.NewEmail},
+	})
+	fmt.Println("Email change requested for user:", userID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Confirmation sent to the new email address"})
+}
+
+// emailLinkPage is served for the links in email change mails. Following a
+// link changes nothing, so mail scanners and link prefetchers that fetch it
+// cannot act on the user's behalf; the button POSTs the token.
+var emailLinkPage = template.Must(template.New("email-link").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><meta name="robots" content="noindex"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">{{.Button}}</button>
+</form>
+</body>
+</html>
+`))
+
+func serveEmailLinkPage(c *gin.Context, action, title, button string) {
+	token := c.Query("token")
+	if token == "" {
+		problem.Abort(c, http.StatusBadRequest, "Missing token")
+		return
+	}
+	var page bytes.Buffer
+	err := emailLinkPage.Execute(&page, map[string]string{"Action": action, "Title": title, "Button": button, "Token": token})
+	if err != nil {
+		problem.AbortError(c, err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// ShowConfirmEmailChange answers the link sent to the new address with a
+// page whose button confirms the change.
+func ShowConfirmEmailChange(c *gin.Context) {
+	serveEmailLinkPage(c, "/auth/email/confirm", "Confirm your new email address", "Confirm")
+}
+
+// ShowUndoEmailChange answers the link sent to the old address with a page
+// whose button cancels or reverts the change.
+func ShowUndoEmailChange(c *gin.Context) {
+	serveEmailLinkPage(c, "/auth/email/undo", "Cancel the change of your email address", "Cancel the change")
+}
+
+// postedToken reads the token of a confirm or undo POST, sent either by the
+// page's form or as JSON.
+func postedToken(c *gin.Context) (string, bool) {
+	if c.ContentType() == "application/json" {
+		var req struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if !bindJSON(c, &req) {
+			return "", false
+		}
+		return req.Token, true
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		problem.Abort(c, http.StatusBadRequest, "Missing token")
+		return "", false
+	}
+	return token, true
+}
+
+// ConfirmEmailChange swaps in the pending email for the change identified by
+// the token sent to the new address.
+func ConfirmEmailChange(db *sql.DB, c *gin.Context) {
+	token, ok := postedToken(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		fmt.Println("Failed to begin transaction:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var changeID int64
+	var userID, oldEmail, newEmail string
+	err = tx.QueryRowContext(c, `SELECT id, user_id, old_email, new_email FROM email_changes
+		WHERE confirm_token_hash = $1 AND confirmed IS NULL AND cancelled IS NULL
+		AND confirm_expires > EXTRACT(EPOCH FROM now()) FOR UPDATE`, hashSecretToken(token)).
+		Scan(&changeID, &userID, &oldEmail, &newEmail)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "Link is invalid or has expired")
+		return
+	} else if err != nil {
+		fmt.Println("DB error fetching email change:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	result, err := tx.ExecContext(c, `UPDATE users SET email = $1, pending_email = NULL, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $2 AND email = $3`, newEmail, userID, oldEmail)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		problem.AbortCode(c, http.StatusConflict, problem.CodeAlreadyExists, "Email is already in use")
+		return
+	} else if err != nil {
+		fmt.Println("Failed to swap email:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		problem.Abort(c, http.StatusConflict, "Email was changed by another request")
+		return
+	}
+	_, err = tx.ExecContext(c, `UPDATE email_changes SET confirmed = EXTRACT(EPOCH FROM now()) WHERE id = $1`, changeID)
+	if err != nil {
+		fmt.Println("Failed to mark email change confirmed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Failed to commit email change:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  userID,
+		TargetID: userID,
+		Action:   audit.ActionEmailChangeConfirm,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"old_email": oldEmail, "new_email": newEmail},
+	})
+	fmt.Println("Email change confirmed for user:", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Email address updated"})
+}
+
+// UndoEmailChange is reached from the notice sent to the old address. An
+// unconfirmed change is cancelled; a confirmed one is reverted and all
+// sessions are revoked, since the change may not have been made by the owner.
+func UndoEmailChange(db *sql.DB, c *gin.Context) {
+	token, ok := postedToken(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		fmt.Println("Failed to begin transaction:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var changeID int64
+	var userID, oldEmail, newEmail string
+	var confirmed sql.NullInt64
+	err = tx.QueryRowContext(c, `SELECT id, user_id, old_email, new_email, confirmed FROM email_changes
+		WHERE undo_token_hash = $1 AND cancelled IS NULL
+		AND undo_expires > EXTRACT(EPOCH FROM now()) FOR UPDATE`, hashSecretToken(token)).
+		Scan(&changeID, &userID, &oldEmail, &newEmail, &confirmed)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "Link is invalid or has expired")
+		return
+	} else if err != nil {
+		fmt.Println("DB error fetching email change:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if confirmed.Valid {
+		_, err = tx.ExecContext(c, `UPDATE users SET email = $1, pending_email = NULL, updated = EXTRACT(EPOCH FROM now())
+			WHERE id = $2 AND email = $3`, oldEmail, userID, newEmail)
+	} else {
+		_, err = tx.ExecContext(c, `UPDATE users SET pending_email = NULL, updated = EXTRACT(EPOCH FROM now())
+			WHERE id = $1 AND pending_email = $2`, userID, newEmail)
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		problem.AbortCode(c, http.StatusConflict, problem.CodeAlreadyExists, "Old email is now used by another account")
+		return
+	} else if err != nil {
+		fmt.Println("Failed to revert email:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	_, err = tx.ExecContext(c, `UPDATE email_changes SET cancelled = EXTRACT(EPOCH FROM now()) WHERE id = $1`, changeID)
+	if err != nil {
+		fmt.Println("Failed to cancel email change:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println("Failed to commit email undo:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if confirmed.Valid {
+		middleware.RevokeTokens(userID)
+	}
+
+	audit.Record(db, c, audit.Event{
+		TargetID: userID,
+		Action:   audit.ActionEmailChangeUndo,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"old_email": oldEmail, "new_email": newEmail, "reverted": confirmed.Valid},
+	})
+	fmt.Println("Email change undone for user:", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Email change cancelled"})
+}
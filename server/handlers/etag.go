@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"rliterate-octo-waddle/server/problem"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// userETag is the strong entity tag for a user row. The version column is
+// bumped by a trigger on every UPDATE, so any change yields a new tag.
+func userETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// userViewETag tags one representation of a user row: the admin, self or
+// public view, narrowed to fields. Different callers and ?fields= lists get
+// different bodies for the same version, so each needs its own tag for
+// If-None-Match. fields must be normalized, i.e. sorted without repeats.
+func userViewETag(version int64, view string, fields []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(fields, ",")))
+	return `"` + strconv.FormatInt(version, 10) + "-" + view + "-" + hex.EncodeToString(sum[:4]) + `"`
+}
+
+// parseETagVersion reads the version from a tag made by userETag or
+// userViewETag. If-Match compares versions only, so any representation's
+// tag is a valid precondition for writing the row.
+func parseETagVersion(tag string) (int64, bool) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	version, _, _ := strings.Cut(tag[1:len(tag)-1], "-")
+	v, err := strconv.ParseInt(version, 10, 64)
+	return v, err == nil
+}
+
+// ifMatch is a parsed If-Match header: either "*" or a list of versions.
+type ifMatch struct {
+	any      bool
+	versions []int64
+}
+
+// arg is the value for a `($n::bigint[] IS NULL OR version = ANY($n))`
+// condition, which passes for any version when If-Match is "*".
+func (m ifMatch) arg() any {
+	if m.any {
+		return nil
+	}
+	return pq.Array(m.versions)
+}
+
+func (m ifMatch) matches(version int64) bool {
+	if m.any {
+		return true
+	}
+	for _, v := range m.versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// requireIfMatch parses the If-Match header that modifying requests must
+// send. It responds 428 and returns false if the header is missing. Weak
+// tags never match, as If-Match uses strong comparison.
+func requireIfMatch(c *gin.Context) (ifMatch, bool) {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		problem.Abort(c, http.StatusPreconditionRequired, "If-Match header with the user's ETag is required")
+		return ifMatch{}, false
+	}
+
+	m := ifMatch{versions: []int64{}}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			m.any = true
+			continue
+		}
+		if v, ok := parseETagVersion(tag); ok {
+			m.versions = append(m.versions, v)
+		}
+	}
+	return m, true
+}
+
+// ifNoneMatch reports whether the If-None-Match header matches etag, in
+// which case a GET should answer 304. Comparison is weak.
+func ifNoneMatch(c *gin.Context, etag string) bool {
+	header := c.GetHeader("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
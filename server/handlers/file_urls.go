@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"rliterate-octo-waddle/server/mailer"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultFileURLExpiry = 5 * time.Minute
+	maxFileURLExpiry     = 7 * 24 * time.Hour
+)
+
+// fileURLKey is the HMAC key for signed download URLs. FILE_URL_SECRET lets
+// it be rotated on its own; otherwise it is derived from ACCESS_SECRET so a
+// leaked URL signature says nothing about the JWT key.
+func fileURLKey() []byte {
+	if secret := os.Getenv("FILE_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	mac := hmac.New(sha256.New, []byte(os.Getenv("ACCESS_SECRET")))
+	mac.Write([]byte("file-url"))
+	return mac.Sum(nil)
+}
+
+// signFileURL signs every parameter of a download URL, so none of them can
+// be changed without invalidating it.
+func signFileURL(id string, expires int64, disposition, filename string) string {
+	mac := hmac.New(sha256.New, fileURLKey())
+	fmt.Fprintf(mac, "%s\n%d\n%s\n%s", id, expires, disposition, filename)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CreateFileURL returns a signed, expiring URL for the file's contents that
+// works without a bearer token, e.g. as the src of an <img> tag.
+func CreateFileURL(db *sql.DB, c *gin.Context) {
+	// The body is optional; expires_in is capped at maxFileURLExpiry.
+	var req struct {
+		ExpiresIn   int64  `json:"expires_in" binding:"min=0,max=604800"`
+		Disposition string `json:"disposition" binding:"omitempty,oneof=attachment inline"`
+		Filename    string `json:"filename" binding:"max=255"`
+	}
+	if c.Request.ContentLength != 0 && !bindJSON(c, &req) {
+		return
+	}
+
+	expiry := defaultFileURLExpiry
+	if req.ExpiresIn != 0 {
+		expiry = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if req.Disposition == "" {
+		req.Disposition = "attachment"
+	}
+	if req.Filename != "" {
+		req.Filename = cleanFileName(req.Filename)
+		if req.Filename == "" {
+			problem.AbortWith(c, problem.Validation("The request body is invalid",
+				problem.FieldError{Field: "/filename", Code: "invalid", Message: "is not a usable file name"}))
+			return
+		}
+	}
+
+	file, ok := loadCallerFile(db, c)
+	if !ok {
+		return
+	}
+
+	expires := time.Now().Add(expiry).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("disposition", req.Disposition)
+	if req.Filename != "" {
+		query.Set("filename", req.Filename)
+	}
+	query.Set("sig", signFileURL(file.ID, expires, req.Disposition, req.Filename))
+
+	c.JSON(http.StatusOK, gin.H{
+		"url":     mailer.PublicURL() + "/files/" + url.PathEscape(file.ID) + "/download?" + query.Encode(),
+		"expires": expires,
+	})
+}
+
+// DownloadSignedFile serves a file named by a URL from CreateFileURL. The
+// signature stands in for authentication, so this route sits outside
+// JWTMiddleware.
+func DownloadSignedFile(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	id := c.Param("id")
+	disposition := c.Query("disposition")
+	filename := c.Query("filename")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeInvalidSignature, "Invalid signature")
+		return
+	}
+	want := signFileURL(id, expires, disposition, filename)
+	if !hmac.Equal([]byte(c.Query("sig")), []byte(want)) {
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeInvalidSignature, "Invalid signature")
+		return
+	}
+	remaining := expires - time.Now().Unix()
+	if remaining <= 0 {
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeLinkExpired, "URL has expired")
+		return
+	}
+
+	// Links outlive the owner's account status, so it is checked here: files
+	// of disabled, deleted or expiring accounts are not served.
+	var file File
+	err = scanFile(db.QueryRowContext(c, `SELECT `+fileColumns+` FROM files
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM users u WHERE u.id = files.owner_id
+			AND u.deleted_at IS NULL AND u.disabled_at IS NULL AND u.purge_after IS NULL)`, id), &file)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "File not found")
+		return
+	} else if err != nil {
+		fmt.Println("File query failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if filename == "" {
+		filename = file.Name
+	}
+	c.Header("Cache-Control", "private, max-age="+strconv.FormatInt(remaining, 10))
+	serveFileContent(blobs, c, file, disposition, filename)
+}
+
+// serveFileContent writes the file's contents through http.ServeContent,
+// which answers Range, If-Range and conditional requests. Blobs are read
+// with ranged gets, so only the requested bytes are fetched. The blob is
+// checked first, as ServeContent has sent its headers by the time a read
+// fails and could then only cut the response short.
+func serveFileContent(blobs storage.BlobStore, c *gin.Context, file File, disposition, filename string) {
+	if _, err := blobs.Stat(c, file.StorageKey); errors.Is(err, storage.ErrNotFound) {
+		fmt.Println("Blob missing for file:", file.ID, file.StorageKey)
+		problem.Abort(c, http.StatusNotFound, "File contents not found")
+		return
+	} else if err != nil {
+		fmt.Println("Blob lookup failed:", file.StorageKey, err)
+		problem.Abort(c, http.StatusInternalServerError, "Storage error")
+		return
+	}
+
+	body := storage.NewReader(c, blobs, file.StorageKey, file.Size)
+	defer body.Close()
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", file.ContentType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	header.Set("ETag", `"`+file.SHA256+`"`)
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Inline content is served from the API's origin; keep any HTML or SVG
+	// from running scripts there.
+	header.Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(c.Writer, c.Request, "", time.Unix(file.Created, 0), body)
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/ids"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMaxUploadBytes = 100 << 20
+	maxFileNameLength     = 255
+	defaultFilePageSize   = 50
+	maxFilePageSize       = 200
+)
+
+// File is a row of the files table. The contents live in a BlobStore under
+// StorageKey.
+type File struct {
+	ID          string `json:"id"`
+	OwnerID     string `json:"owner_id"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Created     int64  `json:"created"`
+	StorageKey  string `json:"-"`
+}
+
+const fileColumns = "id, owner_id, name, content_type, size, sha256, storage_key, created"
+
+func scanFile(row rowScanner, f *File) error {
+	return row.Scan(&f.ID, &f.OwnerID, &f.Name, &f.ContentType, &f.Size, &f.SHA256, &f.StorageKey, &f.Created)
+}
+
+// MaxUploadBytes is the largest accepted upload, configured with
+// FILE_MAX_BYTES.
+func MaxUploadBytes() int64 {
+	if raw := os.Getenv("FILE_MAX_BYTES"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		fmt.Printf("Invalid FILE_MAX_BYTES %q, using %d\n", raw, defaultMaxUploadBytes)
+	}
+	return defaultMaxUploadBytes
+}
+
+// cleanFileName keeps the base name of a client-supplied file name, so
+// paths never end up in metadata or Content-Disposition headers.
+func cleanFileName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+	if r := []rune(name); len(r) > maxFileNameLength {
+		name = string(r[:maxFileNameLength])
+	}
+	return name
+}
+
+// touchUser bumps the owner's updated time, and through the version trigger
+// their ETag, since the files listed on the user changed.
+func touchUser(tx *sql.Tx, c *gin.Context, userID string) error {
+	_, err := tx.ExecContext(c, `UPDATE users SET updated = EXTRACT(EPOCH FROM now()) WHERE id = $1`, userID)
+	return err
+}
+
+// UploadFile stores the multipart form field "file" for the caller.
+func UploadFile(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	callerID := c.GetString("userID")
+	limit := MaxUploadBytes()
+	// Leave room for the multipart framing around the file itself.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1<<20)
+
+	header, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) || (err == nil && header.Size > limit) {
+		problem.Abort(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File must be at most %d bytes", limit))
+		return
+	} else if err != nil {
+		problem.Abort(c, http.StatusBadRequest, "Multipart form field \"file\" is required")
+		return
+	}
+
+	src, err := header.Open()
+	if err != nil {
+		fmt.Println("Failed to open upload:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to read upload")
+		return
+	}
+	defer src.Close()
+
+	id, err := ids.NewV7()
+	if err != nil {
+		fmt.Println("Error generating file ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate file ID")
+		return
+	}
+	file := File{
+		ID:          id,
+		OwnerID:     callerID,
+		Name:        cleanFileName(header.Filename),
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		StorageKey:  callerID + "/" + id,
+	}
+	if _, _, err := mime.ParseMediaType(file.ContentType); err != nil {
+		file.ContentType = "application/octet-stream"
+	}
+
+	hash := sha256.New()
+	if err := blobs.Put(c, file.StorageKey, io.TeeReader(src, hash), file.Size, file.ContentType); err != nil {
+		fmt.Println("Blob upload failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to store file")
+		return
+	}
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	err = insertFile(db, c, &file)
+	if err != nil {
+		fmt.Println("File insert failed:", err)
+		if err := blobs.Delete(c, file.StorageKey); err != nil {
+			fmt.Println("Failed to remove orphaned blob:", file.StorageKey, err)
+		}
+		problem.Abort(c, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  callerID,
+		TargetID: callerID,
+		Action:   audit.ActionFileUpload,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"file_id": file.ID, "size": file.Size},
+	})
+	fmt.Println("File uploaded:", file.ID)
+	c.JSON(http.StatusCreated, file)
+}
+
+func insertFile(db *sql.DB, c *gin.Context, file *File) error {
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertFileTx(tx, c, file); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertFileTx records file within tx and bumps its owner's updated time.
+func insertFileTx(tx *sql.Tx, c *gin.Context, file *File) error {
+	query := `INSERT INTO files (id, owner_id, name, content_type, size, sha256, storage_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created`
+	err := tx.QueryRowContext(c, query, file.ID, file.OwnerID, file.Name, file.ContentType, file.Size, file.SHA256, file.StorageKey).
+		Scan(&file.Created)
+	if err != nil {
+		return err
+	}
+	return touchUser(tx, c, file.OwnerID)
+}
+
+// ListFiles lists the caller's files, oldest first. Admins may pass ?owner=
+// to list another user's files.
+func ListFiles(db *sql.DB, c *gin.Context) {
+	callerID := c.GetString("userID")
+	ownerID := callerID
+	if owner := c.Query("owner"); owner != "" && owner != callerID {
+		admin, err := middleware.IsAdmin(c, db, callerID)
+		if err != nil {
+			fmt.Println("Role lookup failed:", err)
+			problem.Abort(c, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if !admin {
+			problem.Abort(c, http.StatusForbidden, "Only admins may list other users' files")
+			return
+		}
+		ownerID = ResolveUserID(c, db, owner)
+	}
+
+	limit := defaultFilePageSize
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxFilePageSize {
+			problem.Abort(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFilePageSize))
+			return
+		}
+		limit = v
+	}
+
+	// File IDs are UUIDv7, so ordering by ID is ordering by upload time and
+	// the last ID of a page is the cursor for the next.
+	query := `SELECT ` + fileColumns + ` FROM files WHERE owner_id = $1 AND id > $2 ORDER BY id LIMIT $3`
+	rows, err := db.QueryContext(c, query, ownerID, c.Query("cursor"), limit+1)
+	if err != nil {
+		fmt.Println("File query failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		var f File
+		if err := scanFile(rows, &f); err != nil {
+			fmt.Println("Row scan failed:", err)
+			problem.AbortError(c, err)
+			return
+		}
+		files = append(files, f)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println("Row iteration error:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	var nextCursor string
+	if len(files) > limit {
+		files = files[:limit]
+		nextCursor = files[len(files)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"files": files, "next_cursor": nextCursor})
+}
+
+// loadCallerFile fetches the file named by the :id parameter if the caller
+// owns it or is an admin. Other users' files are reported as not found so
+// their existence is not revealed.
+func loadCallerFile(db *sql.DB, c *gin.Context) (File, bool) {
+	var file File
+	err := scanFile(db.QueryRowContext(c, `SELECT `+fileColumns+` FROM files WHERE id = $1`, c.Param("id")), &file)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "File not found")
+		return file, false
+	} else if err != nil {
+		fmt.Println("File query failed:", err)
+		problem.AbortError(c, err)
+		return file, false
+	}
+
+	callerID := c.GetString("userID")
+	if file.OwnerID == callerID {
+		return file, true
+	}
+	admin, err := middleware.IsAdmin(c, db, callerID)
+	if err != nil {
+		fmt.Println("Role lookup failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return file, false
+	}
+	if !admin {
+		problem.Abort(c, http.StatusNotFound, "File not found")
+		return file, false
+	}
+	return file, true
+}
+
+func GetFile(db *sql.DB, c *gin.Context) {
+	file, ok := loadCallerFile(db, c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, file)
+}
+
+func DownloadFile(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	file, ok := loadCallerFile(db, c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "private, no-cache")
+	serveFileContent(blobs, c, file, "attachment", file.Name)
+}
+
+// DeleteFile removes the file's metadata, then its contents. A blob left
+// behind by a failed delete is only logged; it is no longer reachable.
+func DeleteFile(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	file, ok := loadCallerFile(db, c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		fmt.Println("Failed to begin transaction:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(c, `DELETE FROM files WHERE id = $1`, file.ID)
+	if err == nil {
+		var n int64
+		if n, err = result.RowsAffected(); err == nil && n == 0 {
+			problem.Abort(c, http.StatusNotFound, "File not found")
+			return
+		}
+	}
+	if err == nil {
+		err = touchUser(tx, c, file.OwnerID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("File delete failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	if err := blobs.Delete(c, file.StorageKey); err != nil {
+		fmt.Println("Failed to remove blob:", file.StorageKey, err)
+	}
+	audit.Record(db, c, audit.Event{
+		ActorID:  c.GetString("userID"),
+		TargetID: file.OwnerID,
+		Action:   audit.ActionFileDelete,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"file_id": file.ID},
+	})
+	fmt.Println("File deleted:", file.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted!"})
+}
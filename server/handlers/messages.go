@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"rliterate-octo-waddle/server/ids"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
+// Message is a direct message from one user to another.
+type Message struct {
+	ID          string `json:"id"`
+	SenderID    string `json:"sender_id"`
+	RecipientID string `json:"recipient_id"`
+	Body        string `json:"body"`
+	Created     int64  `json:"created"`
+}
+
+const messageColumns = `id, sender_id, recipient_id, body, created`
+
+func scanMessage(row rowScanner, m *Message) error {
+	return row.Scan(&m.ID, &m.SenderID, &m.RecipientID, &m.Body, &m.Created)
+}
+
+// DirectMessageRequest is the payload of a dm websocket message.
+type DirectMessageRequest struct {
+	To   string `json:"to" binding:"required,max=64"`
+	Body string `json:"body" binding:"required,max=4000"`
+}
+
+func (r *DirectMessageRequest) normalize() {
+	r.To = strings.TrimSpace(r.To)
+	r.Body = strings.TrimSpace(r.Body)
+}
+
+// SendDirectMessage validates and stores a message from senderID. Requests
+// that cannot be sent are reported as a *problem.Problem.
+func SendDirectMessage(ctx context.Context, db *sql.DB, senderID string, req DirectMessageRequest) (Message, error) {
+	req.normalize()
+	if fields := validateRequest(&req); len(fields) > 0 {
+		return Message{}, problem.Validation("The message is invalid", fields...)
+	}
+	recipientID := ResolveUserID(ctx, db, req.To)
+	if recipientID == senderID {
+		return Message{}, problem.Validation("The message is invalid",
+			problem.FieldError{Field: "/to", Code: "self", Message: "cannot be yourself"})
+	}
+	if err := middleware.CheckAccountStatus(ctx, db, recipientID); middleware.IsAccountStatusError(err) {
+		return Message{}, problem.New(http.StatusNotFound, "Recipient not found")
+	} else if err != nil {
+		return Message{}, err
+	}
+
+	id, err := ids.NewV7()
+	if err != nil {
+		return Message{}, err
+	}
+	var m Message
+	err = scanMessage(db.QueryRowContext(ctx, `INSERT INTO messages (id, sender_id, recipient_id, body)
+		VALUES ($1, $2, $3, $4) RETURNING `+messageColumns, id, senderID, recipientID, req.Body), &m)
+	return m, err
+}
+
+// GetConversation lists the direct messages between the caller and the user
+// in :id, newest first. Pass next_cursor as cursor to get older messages.
+func GetConversation(db *sql.DB, c *gin.Context) {
+	callerID := c.GetString("userID")
+	otherID := ResolveUserID(c, db, c.Param("id"))
+
+	limit := defaultMessagePageSize
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxMessagePageSize {
+			problem.Abort(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxMessagePageSize))
+			return
+		}
+		limit = v
+	}
+
+	// Message IDs are UUIDv7s from ids.NewV7, which increase even within a
+	// millisecond, so the last ID of a page is the cursor for the next,
+	// older one.
+	query := `SELECT ` + messageColumns + ` FROM messages
+		WHERE LEAST(sender_id, recipient_id) = LEAST($1::text, $2::text)
+			AND GREATEST(sender_id, recipient_id) = GREATEST($1::text, $2::text)
+			AND ($3::text = '' OR id < $3)
+		ORDER BY id DESC LIMIT $4`
+	rows, err := db.QueryContext(c, query, callerID, otherID, c.Query("cursor"), limit+1)
+	if err != nil {
+		fmt.Println("Message query failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := scanMessage(rows, &m); err != nil {
+			fmt.Println("Row scan failed:", err)
+			problem.AbortError(c, err)
+			return
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		fmt.Println("Row iteration error:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	var nextCursor string
+	if len(messages) > limit {
+		messages = messages[:limit]
+		nextCursor = messages[len(messages)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages, "next_cursor": nextCursor})
+}
+
+func exportMessages(ctx context.Context, db *sql.DB, userID string) ([]Message, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE sender_id = $1 OR recipient_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []Message{}
+	for rows.Next() {
+		var m Message
+		if err := scanMessage(rows, &m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/jsonpatch"
+	"rliterate-octo-waddle/server/problem"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxPatchBodyBytes = 64 << 10
+	maxNameLength     = 100
+)
+
+var (
+	selfWritableFields  = []string{"name", "online"}
+	adminWritableFields = slices.Concat(selfWritableFields, []string{"role"})
+)
+
+// PatchUser updates a user with either an RFC 7396 merge patch or an RFC
+// 6902 JSON Patch, chosen by Content-Type. The patch is applied to the
+// caller's view of the user, so users may change their own name and online
+// status, and admins may additionally change anyone's role.
+func PatchUser(users UserRepository, c *gin.Context) {
+	id := users.ResolveID(c, c.Param("id"))
+
+	viewer, err := newUserViewer(users, c)
+	if err != nil {
+		respondViewerError(c, err)
+		return
+	}
+	if !viewer.admin && viewer.callerID != id {
+		problem.Abort(c, http.StatusForbidden, "You may only modify your own account")
+		return
+	}
+
+	precondition, ok := requireIfMatch(c)
+	if !ok {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != jsonpatch.MergePatchContentType && mediaType != jsonpatch.JSONPatchContentType {
+		c.Header("Accept-Patch", jsonpatch.MergePatchContentType+", "+jsonpatch.JSONPatchContentType)
+		problem.Abort(c, http.StatusUnsupportedMediaType, "Content-Type must be "+jsonpatch.MergePatchContentType+" or "+jsonpatch.JSONPatchContentType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPatchBodyBytes+1))
+	if err != nil || len(body) > maxPatchBodyBytes {
+		problem.Abort(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := users.GetByID(c, id, false)
+	if errors.Is(err, ErrUserNotFound) {
+		problem.Abort(c, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		fmt.Println("Query error:", err)
+		problem.AbortError(c, err)
+		return
+	}
+	if !precondition.matches(user.Version) {
+		c.Header("ETag", userETag(user.Version))
+		problem.Abort(c, http.StatusPreconditionFailed, "User was modified by another request, fetch it again and retry")
+		return
+	}
+
+	original := project(viewer.view(user), adminUserFields)
+	current := project(viewer.view(user), adminUserFields)
+
+	var patched any
+	if mediaType == jsonpatch.MergePatchContentType {
+		var patch any
+		if err := json.Unmarshal(body, &patch); err != nil {
+			problem.Abort(c, http.StatusBadRequest, "Invalid merge patch: "+err.Error())
+			return
+		}
+		patched = jsonpatch.MergePatch(current, patch)
+	} else {
+		var ops []jsonpatch.Operation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			problem.Abort(c, http.StatusBadRequest, "Invalid JSON Patch: "+err.Error())
+			return
+		}
+		patched, err = jsonpatch.Apply(current, ops)
+		if errors.Is(err, jsonpatch.ErrTestFailed) {
+			problem.Abort(c, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			problem.Abort(c, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+
+	result, ok := patched.(map[string]any)
+	if !ok {
+		problem.Abort(c, http.StatusUnprocessableEntity, "Patched document must be an object")
+		return
+	}
+
+	writable := selfWritableFields
+	if viewer.admin {
+		writable = adminWritableFields
+	}
+	changed, fieldErrors, status := checkUserPatch(original, result, writable, &user)
+	if len(fieldErrors) > 0 {
+		problem.AbortWith(c, problem.New(status, "Patch rejected").WithErrors(problem.FieldErrors(fieldErrors)...))
+		return
+	}
+	if len(changed) == 0 {
+		c.Header("ETag", viewer.etag(user))
+		c.JSON(http.StatusOK, viewer.view(user))
+		return
+	}
+
+	// The version read above must still be current, so a concurrent write
+	// between the read and this update surfaces as 412 rather than being lost.
+	user, err = users.Patch(c, user, ifMatch{versions: []int64{user.Version}})
+	if errors.Is(err, ErrUserExists) {
+		problem.AbortWith(c, problem.New(http.StatusConflict, "Name is already taken").WithCode(problem.CodeAlreadyExists).
+			WithErrors(problem.FieldError{Field: "/name", Code: "taken", Message: "is already taken"}))
+		return
+	} else if err != nil {
+		respondUserWriteError(c, id, err)
+		return
+	}
+
+	users.Record(c, audit.Event{
+		ActorID:  viewer.callerID,
+		TargetID: user.ID,
+		Action:   audit.ActionUserUpdate,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"fields": changed, "patch": mediaType},
+	})
+	fmt.Println("User patched successfully:", user.ID, changed)
+	c.Header("ETag", viewer.etag(user))
+	c.JSON(http.StatusOK, viewer.view(user))
+}
+
+// checkUserPatch compares the patched document with the original, checks
+// that only writable fields changed and that their new values are valid,
+// and copies them onto user. It returns the changed field names, or a map of
+// field errors with the status code to respond with.
+func checkUserPatch(original, patched map[string]any, writable []string, user *User) ([]string, map[string]string, int) {
+	keys := map[string]bool{}
+	for k := range original {
+		keys[k] = true
+	}
+	for k := range patched {
+		keys[k] = true
+	}
+
+	var changed []string
+	fieldErrors := map[string]string{}
+	status := http.StatusUnprocessableEntity
+	for key := range keys {
+		before, hadBefore := original[key]
+		after, hasAfter := patched[key]
+		if hadBefore == hasAfter && reflect.DeepEqual(before, after) {
+			continue
+		}
+		if !slices.Contains(adminUserFields, key) {
+			fieldErrors[key] = "unknown field"
+			continue
+		}
+		if !slices.Contains(writable, key) {
+			fieldErrors[key] = "field is read-only"
+			status = http.StatusForbidden
+			continue
+		}
+		if msg := applyUserField(user, key, after, hasAfter); msg != "" {
+			fieldErrors[key] = msg
+			continue
+		}
+		changed = append(changed, key)
+	}
+	if len(fieldErrors) > 0 {
+		return nil, fieldErrors, status
+	}
+	sort.Strings(changed)
+	return changed, nil, 0
+}
+
+func applyUserField(user *User, key string, value any, present bool) string {
+	switch key {
+	case "name":
+		name, ok := value.(string)
+		name = strings.TrimSpace(name)
+		if !present || !ok || name == "" {
+			return "must be a non-empty string"
+		}
+		if len([]rune(name)) > maxNameLength {
+			return fmt.Sprintf("must be at most %d characters", maxNameLength)
+		}
+		user.Name = name
+	case "online":
+		online, ok := value.(bool)
+		if !present || !ok {
+			return "must be a boolean"
+		}
+		user.Online = online
+	case "role":
+		role, ok := value.(string)
+		if !present || !ok || (role != "user" && role != "admin") {
+			return "must be user or admin"
+		}
+		user.Role = role
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/jsonschema"
+	"rliterate-octo-waddle/server/problem"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxProfileBodyBytes = 64 << 10
+
+// ProfileSchemaJSON is the JSON Schema every stored profile satisfies. New
+// settings are added to it rather than to the User struct.
+//
+//go:embed profile_schema.json
+var ProfileSchemaJSON []byte
+
+var profileSchema = func() *jsonschema.Schema {
+	s, err := jsonschema.Compile(ProfileSchemaJSON)
+	if err != nil {
+		panic("profile_schema.json: " + err.Error())
+	}
+	return s
+}()
+
+// profileAccess resolves the :id parameter and checks that the caller may
+// read and write that profile: their own, or anyone's for admins.
+func profileAccess(users UserRepository, c *gin.Context) (string, bool) {
+	id := users.ResolveID(c, c.Param("id"))
+	viewer, err := newUserViewer(users, c)
+	if err != nil {
+		respondViewerError(c, err)
+		return "", false
+	}
+	if !viewer.admin && viewer.callerID != id {
+		problem.Abort(c, http.StatusForbidden, "You may only access your own profile")
+		return "", false
+	}
+	return id, true
+}
+
+// GetUserProfile returns a user's profile. It shares the user's ETag, so a
+// PUT can be made conditional on it.
+func GetUserProfile(users UserRepository, c *gin.Context) {
+	id, ok := profileAccess(users, c)
+	if !ok {
+		return
+	}
+
+	profile, version, err := users.Profile(c, id)
+	if errors.Is(err, ErrUserNotFound) {
+		problem.Abort(c, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		fmt.Println("Profile query failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	// Whether the profile may be read depends on who asks.
+	c.Header("Vary", "Authorization")
+	c.Header("ETag", userETag(version))
+	if ifNoneMatch(c, userETag(version)) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", profile)
+}
+
+// PutUserProfile replaces a user's profile after validating it against
+// profileSchema. Like other user writes it requires If-Match.
+func PutUserProfile(users UserRepository, c *gin.Context) {
+	id, ok := profileAccess(users, c)
+	if !ok {
+		return
+	}
+	precondition, ok := requireIfMatch(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxProfileBodyBytes+1))
+	if err != nil {
+		problem.Abort(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(body) > maxProfileBodyBytes {
+		problem.Abort(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Profile must be at most %d bytes", maxProfileBodyBytes))
+		return
+	}
+	var profile any
+	if err := json.Unmarshal(body, &profile); err != nil {
+		problem.Abort(c, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+		return
+	}
+	if errs := profileSchema.Validate(profile); len(errs) > 0 {
+		fields := map[string]string{}
+		for _, e := range errs {
+			if _, seen := fields[e.Path]; !seen {
+				fields[e.Path] = e.Message
+			}
+		}
+		problem.AbortWith(c, problem.Validation("Profile rejected", problem.FieldErrors(fields)...))
+		return
+	}
+
+	// Re-encoding drops insignificant whitespace and duplicate keys.
+	stored, _ := json.Marshal(profile)
+	version, err := users.SetProfile(c, id, stored, precondition)
+	if err != nil {
+		respondUserWriteError(c, id, err)
+		return
+	}
+
+	keys := []string{}
+	if object, ok := profile.(map[string]any); ok {
+		for key := range object {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	users.Record(c, audit.Event{
+		ActorID:  c.GetString("userID"),
+		TargetID: id,
+		Action:   audit.ActionProfileUpdate,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"keys": keys},
+	})
+	c.Header("ETag", userETag(version))
+	c.Data(http.StatusOK, "application/json; charset=utf-8", stored)
+}
+
+// parseProfileFilters turns profile.<key>[.<key>...]=<value> query
+// parameters into a document for a containment match. Values are typed by
+// the profile schema, so profile.notifications.email=true matches a
+// boolean, and must be valid for their key.
+func parseProfileFilters(c *gin.Context) (map[string]any, error) {
+	var params []string
+	for param := range c.Request.URL.Query() {
+		if strings.HasPrefix(param, "profile.") {
+			params = append(params, param)
+		}
+	}
+	if len(params) == 0 {
+		return nil, nil
+	}
+	sort.Strings(params)
+
+	filter := map[string]any{}
+	for _, param := range params {
+		path := strings.Split(strings.TrimPrefix(param, "profile."), ".")
+		value, err := profileFilterValue(profileSchema.Lookup(path...), c.Query(param))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s", param, err)
+		}
+
+		doc := filter
+		for _, key := range path[:len(path)-1] {
+			child, ok := doc[key].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				doc[key] = child
+			}
+			doc = child
+		}
+		doc[path[len(path)-1]] = value
+	}
+	return filter, nil
+}
+
+func profileFilterValue(schema *jsonschema.Schema, raw string) (any, error) {
+	if schema == nil || len(schema.Type) != 1 {
+		return nil, errors.New("is not a filterable profile key")
+	}
+	var value any
+	switch schema.Type[0] {
+	case "string":
+		value = raw
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		value = b
+	case "number", "integer":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		value = f
+	default:
+		return nil, errors.New("is not a filterable profile key")
+	}
+	if errs := schema.Validate(value); len(errs) > 0 {
+		return nil, errors.New(errs[0].Message)
+	}
+	return value, nil
+}
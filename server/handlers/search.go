@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rliterate-octo-waddle/server/problem"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+	maxSearchTerms        = 8
+)
+
+type SearchHit struct {
+	User  any     `json:"user"`
+	Score float64 `json:"score"`
+}
+
+// searchWords splits free text into at most maxSearchTerms lowercase words.
+// Punctuation is dropped, so words never carry query syntax.
+func searchWords(q string) []string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+	return words
+}
+
+// userSearchQuery is a parsed GET /api/users/search request.
+type userSearchQuery struct {
+	Text   string
+	Words  []string
+	Limit  int
+	Cursor *searchCursor
+	// Emails is set for admins, who also match on email. Everyone else
+	// could otherwise probe for addresses they are not allowed to see.
+	Emails bool
+}
+
+// scoredUser is a search hit as returned by UserRepository.Search.
+type scoredUser struct {
+	User  User
+	Score float64
+}
+
+// searchCursor is the last hit of a page. Hits are ordered by score, then
+// ID, so the next page starts right after it.
+type searchCursor struct {
+	Score float64 `json:"s"`
+	ID    string  `json:"id"`
+}
+
+func encodeSearchCursor(cur searchCursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSearchCursor(raw string) (searchCursor, error) {
+	var cur searchCursor
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cur, err
+	}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return cur, err
+	}
+	if cur.ID == "" {
+		return cur, errors.New("cursor has no id")
+	}
+	return cur, nil
+}
+
+// SearchUsers matches q against name prefixes, and email prefixes for
+// admins, and tolerates typos. Hits are ranked best first.
+func SearchUsers(users UserRepository, c *gin.Context) {
+	q := &userSearchQuery{Text: strings.TrimSpace(c.Query("q")), Limit: defaultSearchPageSize}
+	q.Words = searchWords(q.Text)
+	if len(q.Words) == 0 {
+		problem.Abort(c, http.StatusBadRequest, "q must contain at least one letter or digit")
+		return
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxSearchPageSize {
+			problem.Abort(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSearchPageSize))
+			return
+		}
+		q.Limit = v
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		cur, err := decodeSearchCursor(raw)
+		if err != nil {
+			problem.Abort(c, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		q.Cursor = &cur
+	}
+
+	viewer, err := newUserViewer(users, c)
+	if err != nil {
+		respondViewerError(c, err)
+		return
+	}
+	q.Emails = viewer.admin
+
+	fmt.Println("Searching users for:", q.Text)
+	found, err := users.Search(c, q)
+	if err != nil {
+		fmt.Println("Search query failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	var nextCursor string
+	if len(found) > q.Limit {
+		found = found[:q.Limit]
+		last := found[len(found)-1]
+		nextCursor = encodeSearchCursor(searchCursor{Score: last.Score, ID: last.User.ID})
+	}
+	hits := make([]SearchHit, len(found))
+	for i, hit := range found {
+		hits[i] = SearchHit{User: viewer.view(hit.User), Score: hit.Score}
+	}
+
+	fmt.Println("Search hits:", len(hits))
+	c.JSON(http.StatusOK, gin.H{
+		"hits":        hits,
+		"next_cursor": nextCursor,
+	})
+}
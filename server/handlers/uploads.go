@@ -0,0 +1,610 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/ids"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The tus 1.0.0 resumable upload protocol, https://tus.io/protocols/resumable-upload.
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,expiration,checksum,termination"
+	tusChecksumAlgorithms = "md5,sha1,sha256"
+	tusChunkContentType   = "application/offset+octet-stream"
+
+	// statusChecksumMismatch is the status tus defines for a failed
+	// Upload-Checksum.
+	statusChecksumMismatch = 460
+
+	defaultUploadExpiry = 24 * time.Hour
+)
+
+// UploadExpiry is how long an unfinished upload is kept after its last
+// chunk, configured with UPLOAD_EXPIRY (e.g. "24h").
+func UploadExpiry() time.Duration {
+	if raw := os.Getenv("UPLOAD_EXPIRY"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			return d
+		}
+		fmt.Printf("Invalid UPLOAD_EXPIRY %q, using %s\n", raw, defaultUploadExpiry)
+	}
+	return defaultUploadExpiry
+}
+
+type upload struct {
+	ID          string
+	OwnerID     string
+	Name        string
+	ContentType string
+	Length      int64
+	Offset      int64
+	SHA256      *string
+	FileID      *string
+	Expires     int64
+}
+
+const uploadColumns = "id, owner_id, name, content_type, length, upload_offset, sha256, file_id, expires"
+
+func scanUpload(row rowScanner, u *upload) error {
+	return row.Scan(&u.ID, &u.OwnerID, &u.Name, &u.ContentType, &u.Length, &u.Offset, &u.SHA256, &u.FileID, &u.Expires)
+}
+
+// TusOptions answers protocol discovery. It is registered outside the JWT
+// middleware, as tus clients send OPTIONS without credentials.
+func TusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(MaxUploadBytes(), 10))
+	c.Header("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	c.Status(http.StatusNoContent)
+}
+
+// requireTus sets the Tus-Resumable response header and checks that the
+// client speaks the same protocol version, answering 412 if not.
+func requireTus(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		problem.Abort(c, http.StatusPreconditionFailed, "Tus-Resumable: "+tusVersion+" is required")
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma separated
+// "key base64(value)" pairs, where the value may be omitted.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	out := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return out, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s is not base64", key)
+		}
+		out[key] = string(value)
+	}
+	return out, nil
+}
+
+func uploadExpiresHeader(expires int64) string {
+	return time.Unix(expires, 0).UTC().Format(http.TimeFormat)
+}
+
+// CreateUpload starts a resumable upload (tus creation extension). The
+// metadata keys filename, filetype and sha256 (hex, checked once the upload
+// completes) are understood; others are ignored.
+func CreateUpload(db *sql.DB, c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		problem.Abort(c, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		problem.Abort(c, http.StatusBadRequest, "Upload-Length must be a non-negative integer")
+		return
+	}
+	if limit := MaxUploadBytes(); length > limit {
+		problem.Abort(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("File must be at most %d bytes", limit))
+		return
+	}
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		problem.Abort(c, http.StatusBadRequest, "Invalid Upload-Metadata: "+err.Error())
+		return
+	}
+
+	u := upload{
+		OwnerID:     c.GetString("userID"),
+		Name:        cleanFileName(metadata["filename"]),
+		ContentType: metadata["filetype"],
+		Length:      length,
+		Expires:     time.Now().Add(UploadExpiry()).Unix(),
+	}
+	if _, _, err := mime.ParseMediaType(u.ContentType); err != nil {
+		u.ContentType = "application/octet-stream"
+	}
+	if sum, ok := metadata["sha256"]; ok {
+		sum = strings.ToLower(sum)
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			problem.Abort(c, http.StatusBadRequest, "sha256 metadata must be a hex SHA-256 digest")
+			return
+		}
+		u.SHA256 = &sum
+	}
+	if u.ID, err = ids.NewV7(); err != nil {
+		fmt.Println("Error generating upload ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate upload ID")
+		return
+	}
+
+	query := `INSERT INTO uploads (id, owner_id, name, content_type, length, sha256, expires) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := db.ExecContext(c, query, u.ID, u.OwnerID, u.Name, u.ContentType, u.Length, u.SHA256, u.Expires); err != nil {
+		fmt.Println("Upload insert failed:", err)
+		problem.AbortError(c, err)
+		return
+	}
+
+	fmt.Println("Upload created:", u.ID, u.Length)
+	c.Header("Location", "/api/files/uploads/"+u.ID)
+	c.Header("Upload-Expires", uploadExpiresHeader(u.Expires))
+	c.Status(http.StatusCreated)
+}
+
+// loadCallerUpload fetches the upload named by the :id parameter if the
+// caller owns it. Expired uploads are treated as gone.
+func loadCallerUpload(db *sql.DB, c *gin.Context) (upload, bool) {
+	var u upload
+	query := `SELECT ` + uploadColumns + ` FROM uploads WHERE id = $1 AND owner_id = $2 AND expires > EXTRACT(EPOCH FROM now())`
+	err := scanUpload(db.QueryRowContext(c, query, c.Param("id"), c.GetString("userID")), &u)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "Upload not found")
+		return u, false
+	} else if err != nil {
+		fmt.Println("Upload query failed:", err)
+		problem.AbortError(c, err)
+		return u, false
+	}
+	return u, true
+}
+
+func setUploadHeaders(c *gin.Context, u upload) {
+	c.Header("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	c.Header("Upload-Expires", uploadExpiresHeader(u.Expires))
+	if u.FileID != nil {
+		c.Header("X-File-Id", *u.FileID)
+	}
+}
+
+// GetUploadOffset reports how much of an upload the server has, so the
+// client knows where to resume.
+func GetUploadOffset(db *sql.DB, c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	u, ok := loadCallerUpload(db, c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	setUploadHeaders(c, u)
+	c.Status(http.StatusOK)
+}
+
+// parseUploadChecksum reads an Upload-Checksum header, "<algorithm>
+// <base64 digest>", and returns a hash to feed the chunk through.
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, errors.New("checksum is not base64")
+	}
+	switch algorithm {
+	case "md5":
+		return md5.New(), want, nil
+	case "sha1":
+		return sha1.New(), want, nil
+	case "sha256":
+		return sha256.New(), want, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+}
+
+// PatchUpload appends one chunk at Upload-Offset. A chunk is kept only if
+// it arrives whole and matches its Upload-Checksum; otherwise the client
+// resumes from the previous offset. The last chunk completes the upload and
+// turns it into a file, whose ID is returned in X-File-Id.
+func PatchUpload(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type")); mediaType != tusChunkContentType {
+		problem.Abort(c, http.StatusUnsupportedMediaType, "Content-Type must be "+tusChunkContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		problem.Abort(c, http.StatusBadRequest, "Upload-Offset must be a non-negative integer")
+		return
+	}
+	checksum, want, err := parseUploadChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		problem.Abort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, ok := loadCallerUpload(db, c)
+	if !ok {
+		return
+	}
+	if offset != u.Offset {
+		setUploadHeaders(c, u)
+		problem.Abort(c, http.StatusConflict, fmt.Sprintf("Upload-Offset must be %d", u.Offset))
+		return
+	}
+
+	size := c.Request.ContentLength
+	if size < 0 {
+		problem.Abort(c, http.StatusLengthRequired, "Content-Length is required")
+		return
+	}
+	if offset+size > u.Length {
+		problem.Abort(c, http.StatusRequestEntityTooLarge, "Chunk extends past Upload-Length")
+		return
+	}
+
+	if size > 0 {
+		u, ok = storeUploadChunk(db, blobs, c, u, size, checksum, want)
+		if !ok {
+			return
+		}
+	}
+	if u.Offset == u.Length && u.FileID == nil {
+		u, ok = completeUpload(db, blobs, c, u)
+		if !ok {
+			return
+		}
+	}
+
+	setUploadHeaders(c, u)
+	c.Status(http.StatusNoContent)
+}
+
+func storeUploadChunk(db *sql.DB, blobs storage.BlobStore, c *gin.Context, u upload, size int64, checksum hash.Hash, want []byte) (upload, bool) {
+	partID, err := ids.NewV7()
+	if err != nil {
+		fmt.Println("Error generating part ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate part ID")
+		return u, false
+	}
+	// Parts get unique keys so two requests racing for the same offset never
+	// overwrite each other's blob; the loser removes its own below.
+	key := "uploads/" + u.ID + "/" + partID
+
+	var body io.Reader = c.Request.Body
+	if checksum != nil {
+		body = io.TeeReader(body, checksum)
+	}
+	if err := blobs.Put(c, key, body, size, "application/octet-stream"); err != nil {
+		fmt.Println("Chunk upload failed:", err)
+		problem.Abort(c, http.StatusBadRequest, "Chunk was not received completely, resume from Upload-Offset")
+		return u, false
+	}
+	discard := func() {
+		if err := blobs.Delete(context.Background(), key); err != nil {
+			fmt.Println("Failed to remove rejected chunk:", key, err)
+		}
+	}
+	if checksum != nil && subtle.ConstantTimeCompare(checksum.Sum(nil), want) != 1 {
+		discard()
+		problem.AbortWith(c, &problem.Problem{Status: statusChecksumMismatch, Title: "Checksum Mismatch", Code: problem.CodeChecksumMismatch, Detail: "The chunk does not match its Upload-Checksum"})
+		return u, false
+	}
+
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		discard()
+		fmt.Println("Failed to begin transaction:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return u, false
+	}
+	defer tx.Rollback()
+
+	expires := time.Now().Add(UploadExpiry()).Unix()
+	err = tx.QueryRowContext(c, `UPDATE uploads SET upload_offset = upload_offset + $1, expires = $2
+		WHERE id = $3 AND upload_offset = $4 RETURNING upload_offset`, size, expires, u.ID, u.Offset).Scan(&u.Offset)
+	if err == sql.ErrNoRows {
+		discard()
+		problem.Abort(c, http.StatusConflict, "Upload-Offset changed, send HEAD to find the current offset")
+		return u, false
+	}
+	if err == nil {
+		_, err = tx.ExecContext(c, `INSERT INTO upload_parts (upload_id, part_offset, size, storage_key) VALUES ($1, $2, $3, $4)`,
+			u.ID, u.Offset-size, size, key)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		discard()
+		fmt.Println("Failed to record chunk:", err)
+		problem.AbortError(c, err)
+		return u, false
+	}
+	u.Expires = expires
+	return u, true
+}
+
+type uploadPart struct {
+	size int64
+	key  string
+}
+
+// completeUpload joins the parts of a finished upload into one blob,
+// checks it against the sha256 given at creation and records the file. If
+// it fails part-way the parts are kept, and an empty PATCH at the final
+// offset retries it.
+func completeUpload(db *sql.DB, blobs storage.BlobStore, c *gin.Context, u upload) (upload, bool) {
+	rows, err := db.QueryContext(c, `SELECT size, storage_key FROM upload_parts WHERE upload_id = $1 ORDER BY part_offset`, u.ID)
+	if err != nil {
+		fmt.Println("Part query failed:", err)
+		problem.AbortError(c, err)
+		return u, false
+	}
+	var parts []uploadPart
+	for rows.Next() {
+		var p uploadPart
+		if err := rows.Scan(&p.size, &p.key); err != nil {
+			rows.Close()
+			fmt.Println("Row scan failed:", err)
+			problem.AbortError(c, err)
+			return u, false
+		}
+		parts = append(parts, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		fmt.Println("Row iteration error:", err)
+		problem.AbortError(c, err)
+		return u, false
+	}
+
+	fileID, err := ids.NewV7()
+	if err != nil {
+		fmt.Println("Error generating file ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate file ID")
+		return u, false
+	}
+	file := File{
+		ID:          fileID,
+		OwnerID:     u.OwnerID,
+		Name:        u.Name,
+		ContentType: u.ContentType,
+		Size:        u.Length,
+		StorageKey:  u.OwnerID + "/" + fileID,
+	}
+
+	// Stream the parts one after another so only one is open at a time.
+	pr, pw := io.Pipe()
+	go func() {
+		for _, p := range parts {
+			body, err := blobs.Get(c, p.key)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, body)
+			body.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	sum := sha256.New()
+	err = blobs.Put(c, file.StorageKey, io.TeeReader(pr, sum), file.Size, file.ContentType)
+	pr.CloseWithError(err)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			// The parts are gone if a concurrent request completed the
+			// upload while this one was assembling it.
+			if completed, ok := completedElsewhere(db, c, u); ok {
+				return completed, true
+			}
+			return u, false
+		}
+		fmt.Println("Failed to assemble upload:", u.ID, err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to assemble upload, retry with an empty PATCH")
+		return u, false
+	}
+	file.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	if u.SHA256 != nil && *u.SHA256 != file.SHA256 {
+		if err := blobs.Delete(c, file.StorageKey); err != nil {
+			fmt.Println("Failed to remove mismatched upload:", file.StorageKey, err)
+		}
+		deleteUpload(c, db, blobs, u.ID)
+		problem.AbortWith(c, &problem.Problem{Status: statusChecksumMismatch, Title: "Checksum Mismatch", Code: problem.CodeChecksumMismatch, Detail: "The file does not match its sha256 metadata, upload it again"})
+		return u, false
+	}
+
+	claimed, err := insertUploadFile(db, c, &file, u.ID)
+	if err != nil || !claimed {
+		if err := blobs.Delete(c, file.StorageKey); err != nil {
+			fmt.Println("Failed to remove orphaned blob:", file.StorageKey, err)
+		}
+	}
+	if err != nil {
+		fmt.Println("File insert failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to save file, retry with an empty PATCH")
+		return u, false
+	}
+	if !claimed {
+		// A concurrent request completed the upload first; answer with its file.
+		return completedElsewhere(db, c, u)
+	}
+	u.FileID = &file.ID
+	removeUploadParts(c, db, blobs, u.ID)
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  u.OwnerID,
+		TargetID: u.OwnerID,
+		Action:   audit.ActionFileUpload,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"file_id": file.ID, "size": file.Size, "upload_id": u.ID},
+	})
+	fmt.Println("Upload completed:", u.ID, "as file", file.ID)
+	return u, true
+}
+
+// completedElsewhere reloads an upload that another request may have
+// completed. It answers 500 if the upload still has no file, and 404 if it
+// is gone.
+func completedElsewhere(db *sql.DB, c *gin.Context, u upload) (upload, bool) {
+	err := db.QueryRowContext(c, `SELECT file_id FROM uploads WHERE id = $1`, u.ID).Scan(&u.FileID)
+	switch {
+	case err == sql.ErrNoRows:
+		problem.Abort(c, http.StatusNotFound, "Upload not found")
+	case err != nil:
+		fmt.Println("Upload query failed:", err)
+		problem.AbortError(c, err)
+	case u.FileID == nil:
+		fmt.Println("Upload parts are missing:", u.ID)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to assemble upload, retry with an empty PATCH")
+	default:
+		return u, true
+	}
+	return u, false
+}
+
+// insertUploadFile records file and links the upload to it in one
+// transaction. It reports false and saves nothing if the upload already has
+// a file, so of two requests completing the same upload only one creates it.
+func insertUploadFile(db *sql.DB, c *gin.Context, file *File, uploadID string) (bool, error) {
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := insertFileTx(tx, c, file); err != nil {
+		return false, err
+	}
+	result, err := tx.ExecContext(c, `UPDATE uploads SET file_id = $1 WHERE id = $2 AND file_id IS NULL`, file.ID, uploadID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// removeUploadParts deletes the part rows of an upload and then their
+// blobs. Blob failures are only logged.
+func removeUploadParts(ctx context.Context, db *sql.DB, blobs storage.BlobStore, uploadID string) {
+	rows, err := db.QueryContext(ctx, `DELETE FROM upload_parts WHERE upload_id = $1 RETURNING storage_key`, uploadID)
+	if err != nil {
+		fmt.Println("Failed to remove upload parts:", uploadID, err)
+		return
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			fmt.Println("Failed to remove upload part:", key, err)
+		}
+	}
+}
+
+func deleteUpload(ctx context.Context, db *sql.DB, blobs storage.BlobStore, uploadID string) {
+	removeUploadParts(ctx, db, blobs, uploadID)
+	if _, err := db.ExecContext(ctx, `DELETE FROM uploads WHERE id = $1`, uploadID); err != nil {
+		fmt.Println("Failed to remove upload:", uploadID, err)
+	}
+}
+
+// TerminateUpload abandons an upload and frees its chunks (tus termination
+// extension). A completed upload's file is not affected.
+func TerminateUpload(db *sql.DB, blobs storage.BlobStore, c *gin.Context) {
+	if !requireTus(c) {
+		return
+	}
+	u, ok := loadCallerUpload(db, c)
+	if !ok {
+		return
+	}
+	deleteUpload(c, db, blobs, u.ID)
+	fmt.Println("Upload terminated:", u.ID)
+	c.Status(http.StatusNoContent)
+}
+
+// ExpireUploads removes uploads past their expiry together with their
+// chunks, and returns how many were removed.
+func ExpireUploads(db *sql.DB, blobs storage.BlobStore) (int, error) {
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx, `SELECT id FROM uploads WHERE expires <= EXTRACT(EPOCH FROM now())`)
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range expired {
+		deleteUpload(ctx, db, blobs, id)
+	}
+	return len(expired), nil
+}
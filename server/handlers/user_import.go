@@ -0,0 +1,548 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/mailer"
+	"rliterate-octo-waddle/server/problem"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxImportBytes = 10 << 20
+	maxImportRows  = 10_000
+	// maxHTTPImportRows keeps an import's password hashing within a request
+	// timeout; larger files go through the users import command.
+	maxHTTPImportRows = 1_000
+	inviteWindow      = 7 * 24 * time.Hour
+
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+var (
+	// importColumns are the fields an imported row may set.
+	importColumns = []string{"name", "email", "password", "role"}
+	// exportOnlyColumns appear in exports but are assigned afresh on import,
+	// so an export can be imported as is.
+	exportOnlyColumns = []string{"id", "online", "created", "updated", "disabled_at", "deleted_at"}
+)
+
+// ImportOptions controls RunUserImport.
+type ImportOptions struct {
+	Format string
+	// DryRun validates and inserts every row, then rolls back, so conflicts
+	// with existing users and within the file are reported too.
+	DryRun bool
+	// Invite lets rows leave password empty. Those users are emailed a link
+	// to set one.
+	Invite bool
+	// ActorID is recorded as the actor of the audit events.
+	ActorID string
+	// MaxRows caps the number of rows read, maxImportRows if zero.
+	MaxRows int
+}
+
+type ImportRowError struct {
+	// Row is the line of the input the row starts on.
+	Row   int    `json:"row"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportReport sums up an import. In a dry run Created and Invited count the
+// users that would have been created and invited.
+type ImportReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Rows    int              `json:"rows"`
+	Created int              `json:"created"`
+	Invited int              `json:"invited"`
+	Failed  int              `json:"failed"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+func (r *ImportReport) fail(row importRow, msg string) {
+	r.Failed++
+	r.Errors = append(r.Errors, ImportRowError{Row: row.line, Email: row.fields["email"], Error: msg})
+}
+
+// ImportInputError is returned by RunUserImport when the input cannot be
+// read at all, as opposed to individual rows being rejected.
+type ImportInputError struct {
+	Err error
+}
+
+func (e *ImportInputError) Error() string { return e.Err.Error() }
+func (e *ImportInputError) Unwrap() error { return e.Err }
+
+// tooManyRowsError is the ImportInputError for input over the row limit.
+type tooManyRowsError struct {
+	max int
+}
+
+func (e *tooManyRowsError) Error() string {
+	return fmt.Sprintf("at most %d rows can be imported at once", e.max)
+}
+
+type importRow struct {
+	line   int
+	fields map[string]string
+	err    error
+	// hash is the bcrypt hash of the password, set once the row is valid.
+	hash string
+}
+
+// formatFromContentType maps a request's Content-Type to an import format.
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV
+	case "application/x-ndjson", "application/jsonl":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+func readImportRows(r io.Reader, format string, maxRows int) ([]importRow, error) {
+	switch format {
+	case FormatCSV:
+		return readCSVRows(r, maxRows)
+	case FormatNDJSON:
+		return readNDJSONRows(r, maxRows)
+	}
+	return nil, fmt.Errorf("format must be %s or %s", FormatCSV, FormatNDJSON)
+}
+
+func checkImportColumn(column string) error {
+	if !slices.Contains(importColumns, column) && !slices.Contains(exportOnlyColumns, column) {
+		return fmt.Errorf("unknown column %q, allowed columns are %s", column, strings.Join(importColumns, ", "))
+	}
+	return nil
+}
+
+// readCSVRows reads a CSV file whose first record names the columns.
+// Records with the wrong number of fields become row errors; malformed CSV
+// fails the whole import. Cells escaped by escapeCSVCell are unescaped.
+func readCSVRows(r io.Reader, maxRows int) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV is empty")
+	} else if err != nil {
+		return nil, err
+	}
+	for i, column := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(column))
+		if err := checkImportColumn(header[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(err, csv.ErrFieldCount) {
+			rows = append(rows, importRow{line: parseErr.StartLine, err: fmt.Errorf("expected %d fields", len(header))})
+		} else if err != nil {
+			return nil, err
+		} else {
+			line, _ := reader.FieldPos(0)
+			row := importRow{line: line, fields: map[string]string{}}
+			for i, value := range record {
+				// Passwords are never exported, so only other cells can
+				// carry the formula escape of an export.
+				if header[i] != "password" {
+					value = unescapeCSVCell(value)
+				}
+				row.fields[header[i]] = value
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) > maxRows {
+			return nil, &tooManyRowsError{max: maxRows}
+		}
+	}
+}
+
+// readNDJSONRows reads one JSON object per line. Blank lines are skipped.
+func readNDJSONRows(r io.Reader, maxRows int) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := importRow{line: line, fields: map[string]string{}}
+		var object map[string]any
+		if err := json.Unmarshal([]byte(text), &object); err != nil {
+			row.err = errors.New("invalid JSON object")
+		}
+		for key, value := range object {
+			if err := checkImportColumn(key); err != nil {
+				row.err = err
+				break
+			}
+			if !slices.Contains(importColumns, key) {
+				continue
+			}
+			s, ok := value.(string)
+			if !ok && value != nil {
+				row.err = fmt.Errorf("%s must be a string", key)
+				break
+			}
+			row.fields[key] = s
+		}
+		rows = append(rows, row)
+		if len(rows) > maxRows {
+			return nil, &tooManyRowsError{max: maxRows}
+		}
+	}
+	return rows, scanner.Err()
+}
+
+// validateImportRow normalises a row in place and returns why it cannot be
+// imported, if it cannot.
+func validateImportRow(row importRow, opts ImportOptions) string {
+	if row.err != nil {
+		return row.err.Error()
+	}
+	// Rows follow the same rules as registration. A missing password is
+	// checked below, since invited users have none.
+	f := row.fields
+	user := UserCreate{Name: f["name"], Email: f["email"], Password: f["password"]}
+	user.normalize()
+	f["name"], f["email"] = user.Name, user.Email
+	f["role"] = strings.ToLower(strings.TrimSpace(f["role"]))
+	for _, fe := range validateRequest(&user) {
+		if fe.Field == "/password" && user.Password == "" {
+			continue
+		}
+		return strings.TrimPrefix(fe.Field, "/") + " " + fe.Message
+	}
+	if f["role"] == "" {
+		f["role"] = "user"
+	}
+	if f["role"] != "user" && f["role"] != "admin" {
+		return "role must be user or admin"
+	}
+	if f["password"] == "" && !opts.Invite {
+		return "password is required unless users are invited"
+	}
+	return ""
+}
+
+// hashImportPasswords sets the hash of every row that has a password, with
+// one bcrypt worker per CPU. Invited users have no usable password until
+// they accept; bcrypt never matches an empty hash.
+func hashImportPasswords(ctx context.Context, rows []importRow) error {
+	next := make(chan int)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				hash, err := HashedPassword(rows[i].fields["password"])
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("row %d: %w", rows[i].line, err):
+					default:
+					}
+					continue
+				}
+				rows[i].hash = hash
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := range rows {
+		if rows[i].fields["password"] == "" {
+			continue
+		}
+		select {
+		case next <- i:
+		case err = <-errs:
+			break feed
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-errs:
+	default:
+	}
+	return err
+}
+
+type pendingInvite struct {
+	row   importRow
+	token string
+}
+
+// RunUserImport creates a user for every valid row read from r, in a single
+// transaction. Rows that fail are skipped and reported; the others are
+// committed unless opts.DryRun is set. Invite emails are sent after commit.
+func RunUserImport(ctx context.Context, db *sql.DB, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	if opts.MaxRows == 0 {
+		opts.MaxRows = maxImportRows
+	}
+	rows, err := readImportRows(r, opts.Format, opts.MaxRows)
+	if err != nil {
+		return nil, &ImportInputError{Err: err}
+	}
+	report := &ImportReport{DryRun: opts.DryRun, Rows: len(rows), Errors: []ImportRowError{}}
+
+	// Rows are checked and their passwords hashed before the transaction
+	// starts, so the deliberately slow hashing never holds it open.
+	var valid []importRow
+	for _, row := range rows {
+		if msg := validateImportRow(row, opts); msg != "" {
+			report.fail(row, msg)
+			continue
+		}
+		valid = append(valid, row)
+	}
+	// Dry runs skip the hashing.
+	if !opts.DryRun {
+		if err := hashImportPasswords(ctx, valid); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var invites []pendingInvite
+	for _, row := range valid {
+		invite, err := importUser(ctx, tx, row, opts)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			report.fail(row, "name or email is already taken")
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("row %d: %w", row.line, err)
+		}
+		report.Created++
+		if invite != "" {
+			report.Invited++
+			invites = append(invites, pendingInvite{row: row, token: invite})
+		}
+	}
+	slices.SortStableFunc(report.Errors, func(a, b ImportRowError) int { return a.Row - b.Row })
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, invite := range invites {
+		if err := sendInvite(invite.row.fields["email"], invite.token); err != nil {
+			fmt.Println("Failed to send invite email:", err)
+			report.Errors = append(report.Errors, ImportRowError{
+				Row:   invite.row.line,
+				Email: invite.row.fields["email"],
+				Error: "user was created but the invite email could not be sent",
+			})
+		}
+	}
+	return report, nil
+}
+
+// importUser inserts one row inside a savepoint, so a conflict only undoes
+// that row. It returns the invite token if the user was invited.
+func importUser(ctx context.Context, tx *sql.Tx, row importRow, opts ImportOptions) (string, error) {
+	f := row.fields
+	id, err := GenerateUserID()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT import_row`); err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO users (id, name, email, password, role) VALUES ($1, $2, $3, $4, $5)`,
+		id, f["name"], f["email"], row.hash, f["role"])
+	var token string
+	if err == nil && f["password"] == "" {
+		var tokenHash string
+		if token, tokenHash, err = newSecretToken(); err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO user_invites (token_hash, user_id, expires) VALUES ($1, $2, $3)`,
+				tokenHash, id, time.Now().Add(inviteWindow).Unix())
+		}
+	}
+	if err == nil {
+		metadata, _ := json.Marshal(map[string]any{"invited": token != "", "row": row.line})
+		_, err = tx.ExecContext(ctx, `INSERT INTO audit_events (actor_id, target_id, action, outcome, metadata)
+			VALUES ($1, $2, $3, $4, $5)`, opts.ActorID, id, audit.ActionUserImport, audit.OutcomeSuccess, string(metadata))
+	}
+	if err != nil {
+		if _, rollbackErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT import_row`); rollbackErr != nil {
+			return "", rollbackErr
+		}
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `RELEASE SAVEPOINT import_row`)
+	return token, err
+}
+
+// inviteURL is the page invite links point at, configured with INVITE_URL.
+// It should post the token and a new password to /auth/invite/accept.
+func inviteURL() string {
+	if u := os.Getenv("INVITE_URL"); u != "" {
+		return u
+	}
+	return mailer.PublicURL() + "/invite"
+}
+
+func sendInvite(email, token string) error {
+	link := inviteURL() + "?token=" + url.QueryEscape(token)
+	return mailer.Send(email, "You have been invited",
+		"An account has been created for you. Follow this link within 7 days to choose your password:\n\n"+link+"\n")
+}
+
+// ImportUsers is the admin endpoint for RunUserImport. The format comes from
+// ?format= or the Content-Type; ?dry_run=true and ?invite=true set the
+// options of the same names.
+func ImportUsers(db *sql.DB, c *gin.Context) {
+	format := c.Query("format")
+	if format == "" {
+		format = formatFromContentType(c.GetHeader("Content-Type"))
+	}
+	opts := ImportOptions{
+		Format:  format,
+		DryRun:  c.Query("dry_run") == "true",
+		Invite:  c.Query("invite") == "true",
+		ActorID: c.GetString("userID"),
+		MaxRows: maxHTTPImportRows,
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	report, err := RunUserImport(c, db, body, opts)
+	var tooLarge *http.MaxBytesError
+	var tooManyRows *tooManyRowsError
+	var inputErr *ImportInputError
+	if errors.As(err, &tooLarge) {
+		problem.Abort(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Import must be at most %d bytes", maxImportBytes))
+		return
+	} else if errors.As(err, &tooManyRows) {
+		problem.Abort(c, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Import must be at most %d rows, use the users import command for larger files", tooManyRows.max))
+		return
+	} else if errors.As(err, &inputErr) {
+		problem.Abort(c, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		fmt.Println("User import failed:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Import failed, nothing was imported")
+		return
+	}
+
+	fmt.Printf("User import by %s: %d rows, %d created, %d failed, dry run %t\n",
+		opts.ActorID, report.Rows, report.Created, report.Failed, report.DryRun)
+	c.JSON(http.StatusOK, report)
+}
+
+// AcceptInvite sets the password of an imported user from the token in their
+// invite email. Any other invites for the user stop working.
+func AcceptInvite(db *sql.DB, c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=8,maxbytes=72"`
+	}
+	if !bindJSON(c, &req) {
+		return
+	}
+	hash, err := HashedPassword(req.Password)
+	if err != nil {
+		fmt.Println("Error hashing password:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to hash password")
+		return
+	}
+
+	tx, err := db.BeginTx(c, nil)
+	if err != nil {
+		fmt.Println("Failed to begin transaction:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(c, `SELECT user_id FROM user_invites
+		WHERE token_hash = $1 AND accepted IS NULL AND expires > EXTRACT(EPOCH FROM now()) FOR UPDATE`,
+		hashSecretToken(req.Token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		problem.Abort(c, http.StatusNotFound, "Invite is invalid or has expired")
+		return
+	} else if err != nil {
+		fmt.Println("DB error fetching invite:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	result, err := tx.ExecContext(c, `UPDATE users SET password = $1, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $2 AND deleted_at IS NULL`, hash, userID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			problem.Abort(c, http.StatusNotFound, "Invite is invalid or has expired")
+			return
+		}
+		_, err = tx.ExecContext(c, `UPDATE user_invites SET accepted = EXTRACT(EPOCH FROM now())
+			WHERE user_id = $1 AND accepted IS NULL`, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println("Failed to accept invite:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	audit.Record(db, c, audit.Event{
+		ActorID:  userID,
+		TargetID: userID,
+		Action:   audit.ActionInviteAccept,
+		Outcome:  audit.OutcomeSuccess,
+	})
+	fmt.Println("Invite accepted for user:", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Password set, please log in"})
+}
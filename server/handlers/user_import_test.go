@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHashImportPasswords(t *testing.T) {
+	rows := make([]importRow, 12)
+	for i := range rows {
+		rows[i] = importRow{line: i + 2, fields: map[string]string{"password": "password-" + strconv.Itoa(i)}}
+	}
+	rows[3].fields["password"] = "" // invited
+
+	if err := hashImportPasswords(context.Background(), rows); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if row.fields["password"] == "" {
+			if row.hash != "" {
+				t.Errorf("row %d: invited user got hash %q", i, row.hash)
+			}
+			continue
+		}
+		if !CheckPasswordHash(row.fields["password"], row.hash) {
+			t.Errorf("row %d: hash %q does not match its password", i, row.hash)
+		}
+	}
+}
+
+func TestReadImportRowsLimit(t *testing.T) {
+	csv := "name,email,password\n" + strings.Repeat("A,a@example.com,password\n", 3)
+	if _, err := readImportRows(strings.NewReader(csv), FormatCSV, 3); err != nil {
+		t.Errorf("3 rows with a limit of 3: %v", err)
+	}
+	_, err := readImportRows(strings.NewReader(csv), FormatCSV, 2)
+	var tooMany *tooManyRowsError
+	if !errors.As(err, &tooMany) || tooMany.max != 2 {
+		t.Errorf("3 rows with a limit of 2: err = %v, want tooManyRowsError", err)
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+// userSortColumns maps the sort query parameter to its column. The user ID
+// is always appended as a tie-breaker so that keyset pages are stable.
+var userSortColumns = map[string]string{
+	"created": "created",
+	"updated": "updated",
+	"name":    "name",
+}
+
+type userCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value any    `json:"v"`
+	ID    string `json:"id"`
+}
+
+func encodeUserCursor(cur userCursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(raw string) (userCursor, error) {
+	var cur userCursor
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(b, &cur)
+	return cur, err
+}
+
+// userListQuery is a parsed GET /api/users request. It says nothing about
+// SQL; each UserRepository turns it into its own lookup.
+type userListQuery struct {
+	Sort       string
+	Order      string
+	Limit      int
+	CountTotal bool
+	Cursor     *userCursor
+
+	WithDeleted   bool
+	Online        *bool
+	CreatedAfter  *int64
+	CreatedBefore *int64
+	EmailDomain   string
+	// Profile is a document the user's profile must contain, built from
+	// profile.<key>=<value> parameters.
+	Profile map[string]any
+}
+
+// parseUserListQuery reads the pagination, sort and filter parameters of
+// GET /api/users.
+func parseUserListQuery(c *gin.Context, withDeleted bool) (*userListQuery, error) {
+	q := &userListQuery{
+		Sort:        c.DefaultQuery("sort", "created"),
+		Order:       c.DefaultQuery("order", "asc"),
+		Limit:       defaultUserPageSize,
+		CountTotal:  c.Query("count") == "true",
+		WithDeleted: withDeleted,
+	}
+
+	if _, ok := userSortColumns[q.Sort]; !ok {
+		return nil, fmt.Errorf("sort must be one of created, updated, name")
+	}
+	if q.Order != "asc" && q.Order != "desc" {
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxUserPageSize)
+		}
+		q.Limit = limit
+	}
+
+	if raw := c.Query("online"); raw != "" {
+		online, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("online must be true or false")
+		}
+		q.Online = &online
+	}
+	for param, dest := range map[string]**int64{
+		"created_after":  &q.CreatedAfter,
+		"created_before": &q.CreatedBefore,
+	} {
+		raw := c.Query(param)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a unix timestamp", param)
+		}
+		*dest = &v
+	}
+	q.EmailDomain = strings.ToLower(strings.TrimPrefix(c.Query("email_domain"), "@"))
+	profile, err := parseProfileFilters(c)
+	if err != nil {
+		return nil, err
+	}
+	q.Profile = profile
+
+	if raw := c.Query("cursor"); raw != "" {
+		cur, err := decodeUserCursor(raw)
+		if err != nil || cur.Sort != q.Sort || cur.Order != q.Order || cur.ID == "" {
+			return nil, fmt.Errorf("cursor is invalid for this sort order")
+		}
+		// Numeric sort values come back from JSON as float64.
+		if f, ok := cur.Value.(float64); ok && q.Sort != "name" {
+			cur.Value = int64(f)
+		} else if _, ok := cur.Value.(string); !ok || q.Sort != "name" {
+			return nil, fmt.Errorf("cursor is invalid for this sort order")
+		}
+		q.Cursor = &cur
+	}
+	return q, nil
+}
+
+func (q *userListQuery) nextCursor(last User) string {
+	var value any
+	switch q.Sort {
+	case "created":
+		value = last.Created
+	case "updated":
+		value = last.Updated
+	case "name":
+		value = last.Name
+	}
+	return encodeUserCursor(userCursor{Sort: q.Sort, Order: q.Order, Value: value, ID: last.ID})
+}
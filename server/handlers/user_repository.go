@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/problem"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("name or email is already taken")
+)
+
+// StaleVersionError is returned by conditional writes when the user exists
+// but its version does not satisfy If-Match.
+type StaleVersionError struct {
+	Current int64
+}
+
+func (e *StaleVersionError) Error() string {
+	return fmt.Sprintf("user is at version %d", e.Current)
+}
+
+// UserRepository is the storage the user handlers in users.go run against.
+// Lookups and writes only see users that are not soft-deleted unless they
+// say otherwise. PostgresUserRepository is used in production and
+// MemoryUserRepository in tests.
+type UserRepository interface {
+	// Create inserts user, filling in its timestamps, version and role.
+	Create(ctx context.Context, user *User) error
+	GetByID(ctx context.Context, id string, withDeleted bool) (User, error)
+	// GetByEmail also returns the account's purge_after, if deletion was
+	// requested.
+	GetByEmail(ctx context.Context, email string) (User, *int64, error)
+	// List returns at most q.Limit+1 users, so the caller can tell whether
+	// another page follows.
+	List(ctx context.Context, q *userListQuery) ([]User, error)
+	// Count returns how many users match q's filters, ignoring its cursor.
+	Count(ctx context.Context, q *userListQuery) (int64, error)
+	// Search returns at most q.Limit+1 hits, best first, so the caller can
+	// tell whether another page follows.
+	Search(ctx context.Context, q *userSearchQuery) ([]scoredUser, error)
+	// Update saves name and online and returns the new version.
+	Update(ctx context.Context, user User, precondition ifMatch) (int64, error)
+	// Patch saves name, online and role and returns the updated user.
+	Patch(ctx context.Context, user User, precondition ifMatch) (User, error)
+	SoftDelete(ctx context.Context, id string, precondition ifMatch) error
+	// Profile returns the user's profile document and version.
+	Profile(ctx context.Context, id string) (json.RawMessage, int64, error)
+	// SetProfile replaces the profile and returns the new version.
+	SetProfile(ctx context.Context, id string, profile json.RawMessage, precondition ifMatch) (int64, error)
+	PasswordHash(ctx context.Context, id string) (string, error)
+	SetPasswordHash(ctx context.Context, id, hash string) error
+	// ResolveID maps a legacy user ID to the current one; see ResolveUserID.
+	ResolveID(ctx context.Context, id string) string
+	IsAdmin(ctx context.Context, id string) (bool, error)
+	// Record writes an audit event; see audit.Record.
+	Record(c *gin.Context, e audit.Event)
+}
+
+// userExistsProblem reports ErrUserExists, naming the clashing field when
+// the repository passed on the database error.
+func userExistsProblem(err error) *problem.Problem {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return problem.FromError(pqErr)
+	}
+	return problem.New(http.StatusConflict, "Name or email is already taken").WithCode(problem.CodeAlreadyExists)
+}
+
+// respondUserWriteError reports a failed conditional write: 404 for a
+// missing user, 412 with the current ETag for a stale If-Match.
+func respondUserWriteError(c *gin.Context, id string, err error) {
+	var stale *StaleVersionError
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		fmt.Println("No user found with ID:", id)
+		problem.Abort(c, http.StatusNotFound, "User not found")
+	case errors.As(err, &stale):
+		c.Header("ETag", userETag(stale.Current))
+		problem.Abort(c, http.StatusPreconditionFailed, "User was modified by another request, fetch it again and retry")
+	default:
+		fmt.Println("User write failed:", err)
+		problem.AbortError(c, err)
+	}
+}
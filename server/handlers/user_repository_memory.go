@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"rliterate-octo-waddle/server/audit"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MemoryUserRepository keeps users in memory. It mirrors the Postgres
+// behaviour the handlers rely on, including version bumps on every write,
+// so handlers can be exercised without a database.
+type MemoryUserRepository struct {
+	mu         sync.Mutex
+	users      map[string]User
+	purgeAfter map[string]int64
+	aliases    map[string]string
+	profiles   map[string]json.RawMessage
+	events     []audit.Event
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{
+		users:      map[string]User{},
+		purgeAfter: map[string]int64{},
+		aliases:    map[string]string{},
+		profiles:   map[string]json.RawMessage{},
+	}
+}
+
+// Put stores user as is, replacing any user with the same ID.
+func (r *MemoryUserRepository) Put(user User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if user.Version == 0 {
+		user.Version = 1
+	}
+	if user.Role == "" {
+		user.Role = "user"
+	}
+	r.users[user.ID] = copyUser(user)
+}
+
+// SetPurgeAfter marks a user as scheduled for deletion.
+func (r *MemoryUserRepository) SetPurgeAfter(id string, purgeAfter int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purgeAfter[id] = purgeAfter
+}
+
+// AddAlias makes legacyID resolve to id.
+func (r *MemoryUserRepository) AddAlias(legacyID, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aliases[legacyID] = id
+}
+
+// Events returns the audit events recorded so far.
+func (r *MemoryUserRepository) Events() []audit.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.events)
+}
+
+func copyUser(u User) User {
+	u.Files = slices.Clone(u.Files)
+	if u.Files == nil {
+		u.Files = []string{}
+	}
+	return u
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.ID == user.ID || u.Name == user.Name || strings.EqualFold(u.Email, user.Email) {
+			return ErrUserExists
+		}
+	}
+	now := time.Now().Unix()
+	user.Created, user.Updated, user.Version, user.Role = now, now, 1, "user"
+	r.users[user.ID] = copyUser(*user)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetByID(ctx context.Context, id string, withDeleted bool) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok || (u.DeletedAt != nil && !withDeleted) {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (User, *int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if !strings.EqualFold(u.Email, email) || u.DeletedAt != nil {
+			continue
+		}
+		if purgeAfter, ok := r.purgeAfter[u.ID]; ok {
+			return copyUser(u), &purgeAfter, nil
+		}
+		return copyUser(u), nil, nil
+	}
+	return User{}, nil, ErrUserNotFound
+}
+
+func (r *MemoryUserRepository) matching(q *userListQuery) []User {
+	var out []User
+	for _, u := range r.users {
+		switch {
+		case u.DeletedAt != nil && !q.WithDeleted:
+		case q.Online != nil && u.Online != *q.Online:
+		case q.CreatedAfter != nil && u.Created < *q.CreatedAfter:
+		case q.CreatedBefore != nil && u.Created >= *q.CreatedBefore:
+		case q.EmailDomain != "" && !strings.EqualFold(emailDomain(u.Email), q.EmailDomain):
+		case q.Profile != nil && !jsonContains(r.profile(u.ID), q.Profile):
+		default:
+			out = append(out, copyUser(u))
+		}
+	}
+	return out
+}
+
+// profile returns the decoded profile of a user. The caller must hold r.mu.
+func (r *MemoryUserRepository) profile(id string) any {
+	var profile any = map[string]any{}
+	if raw, ok := r.profiles[id]; ok {
+		json.Unmarshal(raw, &profile)
+	}
+	return profile
+}
+
+// jsonContains reports whether doc contains want in the sense of the
+// Postgres jsonb @> operator, for the objects and scalars profile filters
+// are made of.
+func jsonContains(doc, want any) bool {
+	wantObject, ok := want.(map[string]any)
+	if !ok {
+		return reflect.DeepEqual(doc, want)
+	}
+	docObject, ok := doc.(map[string]any)
+	if !ok {
+		return false
+	}
+	for key, v := range wantObject {
+		if d, ok := docObject[key]; !ok || !jsonContains(d, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func emailDomain(email string) string {
+	_, domain, _ := strings.Cut(email, "@")
+	return domain
+}
+
+// compareUsers orders users by the sort column of q, then by ID.
+func compareUsers(q *userListQuery, a User, bValue any, bID string) int {
+	var c int
+	switch q.Sort {
+	case "created":
+		c = cmpInt(a.Created, bValue.(int64))
+	case "updated":
+		c = cmpInt(a.Updated, bValue.(int64))
+	case "name":
+		c = strings.Compare(a.Name, bValue.(string))
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, bID)
+	}
+	if q.Order == "desc" {
+		c = -c
+	}
+	return c
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func sortValue(q *userListQuery, u User) any {
+	switch q.Sort {
+	case "updated":
+		return u.Updated
+	case "name":
+		return u.Name
+	}
+	return u.Created
+}
+
+func (r *MemoryUserRepository) List(ctx context.Context, q *userListQuery) ([]User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := r.matching(q)
+	sort.Slice(users, func(i, j int) bool {
+		return compareUsers(q, users[i], sortValue(q, users[j]), users[j].ID) < 0
+	})
+
+	page := []User{}
+	for _, u := range users {
+		if q.Cursor != nil && compareUsers(q, u, q.Cursor.Value, q.Cursor.ID) <= 0 {
+			continue
+		}
+		page = append(page, u)
+		if len(page) == q.Limit+1 {
+			break
+		}
+	}
+	return page, nil
+}
+
+func (r *MemoryUserRepository) Count(ctx context.Context, q *userListQuery) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.matching(q))), nil
+}
+
+// Search matches every word as a prefix of a word of the name, or of the
+// email when q.Emails is set. It does not tolerate typos; a hit scores the
+// share of its matched field that the words cover, so closer matches rank
+// first as they do in Postgres.
+func (r *MemoryUserRepository) Search(ctx context.Context, q *userSearchQuery) ([]scoredUser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hits := []scoredUser{}
+	for _, u := range r.users {
+		if u.DeletedAt != nil {
+			continue
+		}
+		fields := []string{u.Name}
+		if q.Emails {
+			fields = append(fields, u.Email)
+		}
+		var score float64
+		for _, field := range fields {
+			if s := wordsScore(q.Words, field); s > score {
+				score = s
+			}
+		}
+		if score == 0 {
+			continue
+		}
+		if q.Cursor != nil && (score > q.Cursor.Score || score == q.Cursor.Score && u.ID <= q.Cursor.ID) {
+			continue
+		}
+		hits = append(hits, scoredUser{User: copyUser(u), Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].User.ID < hits[j].User.ID
+	})
+	if len(hits) > q.Limit+1 {
+		hits = hits[:q.Limit+1]
+	}
+	return hits, nil
+}
+
+// wordsScore returns 0 unless every word is a prefix of a word of field.
+func wordsScore(words []string, field string) float64 {
+	fieldWords := searchWords(field)
+	covered := 0
+	for _, w := range words {
+		i := slices.IndexFunc(fieldWords, func(f string) bool { return strings.HasPrefix(f, w) })
+		if i < 0 {
+			return 0
+		}
+		covered += len(w)
+	}
+	return float64(covered) / float64(len(field))
+}
+
+// checkWritable returns the live user with the given ID if precondition
+// matches its version. The caller must hold r.mu.
+func (r *MemoryUserRepository) checkWritable(id string, precondition ifMatch) (User, error) {
+	u, ok := r.users[id]
+	if !ok || u.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	if !precondition.matches(u.Version) {
+		return User{}, &StaleVersionError{Current: u.Version}
+	}
+	return u, nil
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, user User, precondition ifMatch) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, err := r.checkWritable(user.ID, precondition)
+	if err != nil {
+		return 0, err
+	}
+	for _, other := range r.users {
+		if other.ID != u.ID && other.Name == user.Name {
+			return 0, ErrUserExists
+		}
+	}
+	u.Name, u.Online = user.Name, user.Online
+	u.Updated = time.Now().Unix()
+	u.Version++
+	r.users[u.ID] = u
+	return u.Version, nil
+}
+
+func (r *MemoryUserRepository) Patch(ctx context.Context, user User, precondition ifMatch) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, err := r.checkWritable(user.ID, precondition)
+	if err != nil {
+		return User{}, err
+	}
+	for _, other := range r.users {
+		if other.ID != u.ID && other.Name == user.Name {
+			return User{}, ErrUserExists
+		}
+	}
+	u.Name, u.Online, u.Role = user.Name, user.Online, user.Role
+	u.Updated = time.Now().Unix()
+	u.Version++
+	r.users[u.ID] = u
+	return copyUser(u), nil
+}
+
+func (r *MemoryUserRepository) SoftDelete(ctx context.Context, id string, precondition ifMatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, err := r.checkWritable(id, precondition)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	u.DeletedAt, u.Online, u.Updated = &now, false, now
+	u.Version++
+	r.users[id] = u
+	return nil
+}
+
+func (r *MemoryUserRepository) Profile(ctx context.Context, id string) (json.RawMessage, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok || u.DeletedAt != nil {
+		return nil, 0, ErrUserNotFound
+	}
+	if raw, ok := r.profiles[id]; ok {
+		return slices.Clone(raw), u.Version, nil
+	}
+	return json.RawMessage("{}"), u.Version, nil
+}
+
+func (r *MemoryUserRepository) SetProfile(ctx context.Context, id string, profile json.RawMessage, precondition ifMatch) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, err := r.checkWritable(id, precondition)
+	if err != nil {
+		return 0, err
+	}
+	r.profiles[id] = slices.Clone(profile)
+	u.Updated = time.Now().Unix()
+	u.Version++
+	r.users[id] = u
+	return u.Version, nil
+}
+
+func (r *MemoryUserRepository) PasswordHash(ctx context.Context, id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	return u.Password, nil
+}
+
+func (r *MemoryUserRepository) SetPasswordHash(ctx context.Context, id, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.Password, u.Updated = hash, time.Now().Unix()
+	u.Version++
+	r.users[id] = u
+	return nil
+}
+
+func (r *MemoryUserRepository) ResolveID(ctx context.Context, id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.aliases[id]; ok {
+		return current
+	}
+	return id
+}
+
+func (r *MemoryUserRepository) IsAdmin(ctx context.Context, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.users[id].Role == "admin", nil
+}
+
+func (r *MemoryUserRepository) Record(c *gin.Context, e audit.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.ID = int64(len(r.events) + 1)
+	e.OccurredAt = time.Now().Unix()
+	e.IP = c.ClientIP()
+	e.UserAgent = c.Request.UserAgent()
+	r.events = append(r.events, e)
+}
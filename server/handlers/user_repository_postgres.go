@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/middleware"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type PostgresUserRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresUserRepository(db *sql.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) Create(ctx context.Context, user *User) error {
+	query := `INSERT INTO users (id, name, email, password, online)
+		VALUES ($1, $2, $3, $4, $5) RETURNING created, updated, version, role`
+	err := r.db.QueryRowContext(ctx, query, user.ID, user.Name, user.Email, user.Password, user.Online).
+		Scan(&user.Created, &user.Updated, &user.Version, &user.Role)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		// Keep the Postgres error so the clashing column can be reported.
+		return fmt.Errorf("%w: %w", ErrUserExists, pqErr)
+	}
+	return err
+}
+
+func (r *PostgresUserRepository) GetByID(ctx context.Context, id string, withDeleted bool) (User, error) {
+	var user User
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1 AND (deleted_at IS NULL OR $2)`
+	err := scanUser(r.db.QueryRowContext(ctx, query, id, withDeleted), &user)
+	if err == sql.ErrNoRows {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (r *PostgresUserRepository) GetByEmail(ctx context.Context, email string) (User, *int64, error) {
+	var user User
+	var purgeAfter sql.NullInt64
+	query := `SELECT ` + userColumns + `, purge_after FROM users WHERE lower(email) = lower($1) AND deleted_at IS NULL`
+	err := scanUser(r.db.QueryRowContext(ctx, query, email), &user, &purgeAfter)
+	if err == sql.ErrNoRows {
+		return user, nil, ErrUserNotFound
+	} else if err != nil || !purgeAfter.Valid {
+		return user, nil, err
+	}
+	return user, &purgeAfter.Int64, nil
+}
+
+// sqlConditions collects WHERE conditions and their arguments; conditions
+// use $n placeholders numbered in the order added.
+type sqlConditions struct {
+	conditions []string
+	args       []any
+}
+
+func (s *sqlConditions) add(condition string, values ...any) {
+	placeholders := make([]any, len(values))
+	for i, v := range values {
+		s.args = append(s.args, v)
+		placeholders[i] = len(s.args)
+	}
+	s.conditions = append(s.conditions, fmt.Sprintf(condition, placeholders...))
+}
+
+func (s *sqlConditions) where() string {
+	if len(s.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(s.conditions, " AND ")
+}
+
+// listFilters turns the filters of q, but not its cursor, into conditions.
+func listFilters(q *userListQuery) *sqlConditions {
+	s := &sqlConditions{}
+	if !q.WithDeleted {
+		s.add("deleted_at IS NULL")
+	}
+	if q.Online != nil {
+		s.add("online = $%d", *q.Online)
+	}
+	if q.CreatedAfter != nil {
+		s.add("created >= $%d", *q.CreatedAfter)
+	}
+	if q.CreatedBefore != nil {
+		s.add("created < $%d", *q.CreatedBefore)
+	}
+	if q.EmailDomain != "" {
+		s.add("lower(split_part(email, '@', 2)) = $%d", q.EmailDomain)
+	}
+	if q.Profile != nil {
+		// Containment rather than ->> comparisons, so users_profile_idx applies.
+		doc, _ := json.Marshal(q.Profile)
+		s.add("profile @> $%d::jsonb", string(doc))
+	}
+	return s
+}
+
+func (r *PostgresUserRepository) List(ctx context.Context, q *userListQuery) ([]User, error) {
+	column := userSortColumns[q.Sort]
+	comparison, direction := ">", "ASC"
+	if q.Order == "desc" {
+		comparison, direction = "<", "DESC"
+	}
+
+	s := listFilters(q)
+	if q.Cursor != nil {
+		s.add("("+column+", id) "+comparison+" ($%d, $%d)", q.Cursor.Value, q.Cursor.ID)
+	}
+	s.args = append(s.args, q.Limit+1)
+	query := "SELECT " + userColumns + " FROM users" + s.where() +
+		fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, direction, direction, len(s.args))
+
+	rows, err := r.db.QueryContext(ctx, query, s.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := scanUser(rows, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r *PostgresUserRepository) Count(ctx context.Context, q *userListQuery) (int64, error) {
+	s := listFilters(q)
+	var total int64
+	err := r.db.QueryRowContext(ctx, "SELECT count(*) FROM users"+s.where(), s.args...).Scan(&total)
+	return total, err
+}
+
+// prefixTSQuery turns search words into a tsquery matching every word as a
+// prefix, e.g. [ali exa] becomes "ali:* & exa:*". searchWords has already
+// dropped punctuation, so user input can never produce tsquery syntax.
+func prefixTSQuery(words []string) string {
+	terms := make([]string, len(words))
+	for i, w := range words {
+		terms[i] = w + ":*"
+	}
+	return strings.Join(terms, " & ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Search matches name prefixes through a tsvector and tolerates typos
+// through trigram similarity, ranking hits by the sum of both scores.
+func (r *PostgresUserRepository) Search(ctx context.Context, q *userSearchQuery) ([]scoredUser, error) {
+	// search_vector covers name and email; without Emails only the name is
+	// matched, through the index migration 0018 adds.
+	vector := `to_tsvector('simple', coalesce(name, ''))`
+	similarity := `similarity(lower(name), input.term)`
+	match := `lower(name) LIKE $3 || '%' OR lower(name) % input.term`
+	if q.Emails {
+		vector = `search_vector`
+		similarity = `greatest(similarity(lower(name), input.term), similarity(lower(email), input.term))`
+		match += ` OR lower(email) LIKE $3 || '%' OR lower(email) % input.term`
+	}
+
+	// Scores are real, so the cursor's score compares exactly once it is
+	// cast back.
+	query := `
+	WITH input AS (
+		SELECT lower($1::text) AS term, to_tsquery('simple', $2) AS tsq
+	), hits AS (
+		SELECT ` + userColumns + `, ts_rank(` + vector + `, input.tsq) + ` + similarity + ` AS score
+		FROM users, input
+		WHERE deleted_at IS NULL AND (` + vector + ` @@ input.tsq OR ` + match + `)
+	)
+	SELECT * FROM hits
+	WHERE $5::text = '' OR score < $6::real OR (score = $6::real AND id > $5)
+	ORDER BY score DESC, id
+	LIMIT $4`
+
+	var cursor searchCursor
+	if q.Cursor != nil {
+		cursor = *q.Cursor
+	}
+	rows, err := r.db.QueryContext(ctx, query, q.Text, prefixTSQuery(q.Words), escapeLike(strings.ToLower(q.Text)),
+		q.Limit+1, cursor.ID, cursor.Score)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []scoredUser{}
+	for rows.Next() {
+		var hit scoredUser
+		if err := scanUser(rows, &hit.User, &hit.Score); err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+func (r *PostgresUserRepository) Update(ctx context.Context, user User, precondition ifMatch) (int64, error) {
+	query := `UPDATE users SET name=$1, online=$2, updated=EXTRACT(EPOCH FROM now())
+		WHERE id=$3 AND deleted_at IS NULL AND ($4::bigint[] IS NULL OR version = ANY($4)) RETURNING version`
+	var version int64
+	err := r.db.QueryRowContext(ctx, query, user.Name, user.Online, user.ID, precondition.arg()).Scan(&version)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return 0, ErrUserExists
+	} else if err == sql.ErrNoRows {
+		return 0, r.noRowsUpdated(ctx, user.ID)
+	}
+	return version, err
+}
+
+func (r *PostgresUserRepository) Patch(ctx context.Context, user User, precondition ifMatch) (User, error) {
+	query := `UPDATE users SET name = $1, online = $2, role = $3, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $4 AND deleted_at IS NULL AND ($5::bigint[] IS NULL OR version = ANY($5)) RETURNING ` + userColumns
+	var updated User
+	err := scanUser(r.db.QueryRowContext(ctx, query, user.Name, user.Online, user.Role, user.ID, precondition.arg()), &updated)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return User{}, ErrUserExists
+	} else if err == sql.ErrNoRows {
+		return User{}, r.noRowsUpdated(ctx, user.ID)
+	}
+	return updated, err
+}
+
+func (r *PostgresUserRepository) SoftDelete(ctx context.Context, id string, precondition ifMatch) error {
+	query := `UPDATE users SET deleted_at = EXTRACT(EPOCH FROM now()), online = false, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $1 AND deleted_at IS NULL AND ($2::bigint[] IS NULL OR version = ANY($2))`
+	result, err := r.db.ExecContext(ctx, query, id, precondition.arg())
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return r.noRowsUpdated(ctx, id)
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) Profile(ctx context.Context, id string) (json.RawMessage, int64, error) {
+	var profile []byte
+	var version int64
+	err := r.db.QueryRowContext(ctx, `SELECT profile, version FROM users WHERE id = $1 AND deleted_at IS NULL`, id).
+		Scan(&profile, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, ErrUserNotFound
+	}
+	return profile, version, err
+}
+
+func (r *PostgresUserRepository) SetProfile(ctx context.Context, id string, profile json.RawMessage, precondition ifMatch) (int64, error) {
+	query := `UPDATE users SET profile = $1, updated = EXTRACT(EPOCH FROM now())
+		WHERE id = $2 AND deleted_at IS NULL AND ($3::bigint[] IS NULL OR version = ANY($3)) RETURNING version`
+	var version int64
+	err := r.db.QueryRowContext(ctx, query, string(profile), id, precondition.arg()).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, r.noRowsUpdated(ctx, id)
+	}
+	return version, err
+}
+
+// noRowsUpdated tells a missing user from a stale If-Match after a
+// conditional UPDATE touched no rows.
+func (r *PostgresUserRepository) noRowsUpdated(ctx context.Context, id string) error {
+	var version int64
+	err := r.db.QueryRowContext(ctx, `SELECT version FROM users WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+	return &StaleVersionError{Current: version}
+}
+
+func (r *PostgresUserRepository) PasswordHash(ctx context.Context, id string) (string, error) {
+	var hash string
+	err := r.db.QueryRowContext(ctx, `SELECT password FROM users WHERE id = $1`, id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return hash, err
+}
+
+func (r *PostgresUserRepository) SetPasswordHash(ctx context.Context, id, hash string) error {
+	result, err := r.db.ExecContext(ctx, `UPDATE users SET password=$1, updated=EXTRACT(EPOCH FROM now()) WHERE id=$2`, hash, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *PostgresUserRepository) ResolveID(ctx context.Context, id string) string {
+	return ResolveUserID(ctx, r.db, id)
+}
+
+func (r *PostgresUserRepository) IsAdmin(ctx context.Context, id string) (bool, error) {
+	return middleware.IsAdmin(ctx, r.db, id)
+}
+
+func (r *PostgresUserRepository) Record(c *gin.Context, e audit.Event) {
+	audit.Record(r.db, c, e)
+}
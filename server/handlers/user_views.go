@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rliterate-octo-waddle/server/problem"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userColumns is the column list scanned by scanUser. Every query that
+// returns users to clients selects these, in this order. files is the IDs of
+// the user's uploads in the files table, oldest first.
+const userColumns = "id, name, email, password, online, " +
+	"ARRAY(SELECT f.id FROM files f WHERE f.owner_id = users.id ORDER BY f.id) AS files, " +
+	"created, updated, version, role, pending_email, disabled_at, deleted_at, avatar"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner, user *User, extra ...any) error {
+	dest := []any{
+		&user.ID, &user.Name, &user.Email, &user.Password, &user.Online, &user.Files,
+		&user.Created, &user.Updated, &user.Version, &user.Role, &user.PendingEmail, &user.DisabledAt, &user.DeletedAt,
+		&user.Avatar,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	if user.Files == nil {
+		user.Files = []string{}
+	}
+	return nil
+}
+
+// PublicUser is what any authenticated caller may see about another user.
+type PublicUser struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Online    bool   `json:"online"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+	Created   int64  `json:"created"`
+}
+
+// SelfUser is what users see about themselves.
+type SelfUser struct {
+	PublicUser
+	Email        string   `json:"email"`
+	PendingEmail *string  `json:"pending_email,omitempty"`
+	Files        []string `json:"files"`
+	Updated      int64    `json:"updated"`
+}
+
+// AdminUser is what admins see about any user.
+type AdminUser struct {
+	SelfUser
+	Role       string `json:"role"`
+	DisabledAt *int64 `json:"disabled_at,omitempty"`
+	DeletedAt  *int64 `json:"deleted_at,omitempty"`
+}
+
+var (
+	publicUserFields = []string{"id", "name", "online", "avatar_url", "created"}
+	selfUserFields   = slices.Concat(publicUserFields, []string{"email", "pending_email", "files", "updated"})
+	adminUserFields  = slices.Concat(selfUserFields, []string{"role", "disabled_at", "deleted_at"})
+)
+
+func publicView(u User) PublicUser {
+	return PublicUser{ID: u.ID, Name: u.Name, Online: u.Online, AvatarURL: avatarURL(u.ID, u.Avatar), Created: u.Created}
+}
+
+func selfView(u User) SelfUser {
+	return SelfUser{
+		PublicUser:   publicView(u),
+		Email:        u.Email,
+		PendingEmail: u.PendingEmail,
+		Files:        u.Files,
+		Updated:      u.Updated,
+	}
+}
+
+func adminView(u User) AdminUser {
+	return AdminUser{
+		SelfUser:   selfView(u),
+		Role:       u.Role,
+		DisabledAt: u.DisabledAt,
+		DeletedAt:  u.DeletedAt,
+	}
+}
+
+// userViewer decides which representation of a user the caller receives
+// and applies the ?fields= projection to it.
+type userViewer struct {
+	callerID string
+	admin    bool
+	fields   []string
+}
+
+// adminChecker looks up whether a user has the admin role.
+type adminChecker interface {
+	IsAdmin(ctx context.Context, id string) (bool, error)
+}
+
+func newUserViewer(roles adminChecker, c *gin.Context) (*userViewer, error) {
+	v := &userViewer{callerID: c.GetString("userID")}
+
+	admin, err := roles.IsAdmin(c, v.callerID)
+	if err != nil {
+		return nil, err
+	}
+	v.admin = admin
+
+	if raw := c.Query("fields"); raw != "" {
+		allowed := selfUserFields
+		if v.admin {
+			allowed = adminUserFields
+		}
+		for _, f := range strings.Split(raw, ",") {
+			f = strings.TrimSpace(f)
+			if f == "" {
+				continue
+			}
+			if !slices.Contains(allowed, f) {
+				return nil, fieldsError{fmt.Sprintf("unknown field %q, allowed fields are %s", f, strings.Join(allowed, ", "))}
+			}
+			v.fields = append(v.fields, f)
+		}
+	}
+	return v, nil
+}
+
+type fieldsError struct{ msg string }
+
+func (e fieldsError) Error() string { return e.msg }
+
+// respondViewerError reports a failure from newUserViewer: 400 for a bad
+// ?fields= list, 500 for anything else.
+func respondViewerError(c *gin.Context, err error) {
+	var fe fieldsError
+	if errors.As(err, &fe) {
+		problem.Abort(c, http.StatusBadRequest, fe.Error())
+		return
+	}
+	fmt.Println("Role lookup failed:", err)
+	problem.Abort(c, http.StatusInternalServerError, "Database error")
+}
+
+// kind names the view the caller gets of u: admin, self or public.
+func (v *userViewer) kind(u User) string {
+	switch {
+	case v.admin:
+		return "admin"
+	case u.ID == v.callerID:
+		return "self"
+	default:
+		return "public"
+	}
+}
+
+func (v *userViewer) view(u User) any {
+	var out any
+	switch v.kind(u) {
+	case "admin":
+		out = adminView(u)
+	case "self":
+		out = selfView(u)
+	default:
+		out = publicView(u)
+	}
+	if len(v.fields) == 0 {
+		return out
+	}
+	return project(out, v.fields)
+}
+
+// etag tags the representation view(u) returns. A projection's keys are
+// written in sorted order, so the order and repeats of ?fields= do not
+// change the body and are normalized away.
+func (v *userViewer) etag(u User) string {
+	fields := slices.Clone(v.fields)
+	slices.Sort(fields)
+	return userViewETag(u.Version, v.kind(u), slices.Compact(fields))
+}
+
+func (v *userViewer) views(users []User) []any {
+	out := make([]any, len(users))
+	for i, u := range users {
+		out[i] = v.view(u)
+	}
+	return out
+}
+
+// project keeps only the requested fields of a view. Fields the view does
+// not carry, e.g. email on another user's public view, are simply absent.
+func project(view any, fields []string) map[string]any {
+	b, _ := json.Marshal(view)
+	var all map[string]any
+	_ = json.Unmarshal(b, &all)
+
+	out := make(map[string]any, len(fields))
+	for _, f := range fields {
+		if value, ok := all[f]; ok {
+			out[f] = value
+		}
+	}
+	return out
+}
@@ -1,18 +1,24 @@
 package handlers
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"net/http"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/ids"
 	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// User is the users row. Requests bind UserCreate or UserUpdate instead, and
+// it is never written to responses directly; see PublicUser, SelfUser and AdminUser.
 type User struct {
 	ID       string         `json:"id"`
 	Name     string         `json:"name"`
@@ -22,28 +28,83 @@ type User struct {
 	Files    pq.StringArray `json:"files" sql:"type:text[]"`
 	Created  int64          `json:"created"`
 	Updated  int64          `json:"updated"`
+
+	Version      int64   `json:"-"`
+	Role         string  `json:"-"`
+	PendingEmail *string `json:"-"`
+	DisabledAt   *int64  `json:"-"`
+	DeletedAt    *int64  `json:"-"`
+	Avatar       *string `json:"-"`
 }
 
-func CreateUsersTable(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT UNIQUE NOT NULL PRIMARY KEY,
-		name TEXT UNIQUE NOT NULL,
-		email TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL,
-		online BOOL DEFAULT false,
-		files TEXT[],
-		created BIGINT DEFAULT (EXTRACT(EPOCH FROM now())),
-    	updated BIGINT DEFAULT (EXTRACT(EPOCH FROM now()))
-	);`
-
-	_, err := db.Exec(query)
-	return err
+// GenerateUserID returns a new opaque user ID. IDs are random rather than
+// derived from the email, so a user keeps their ID when their email changes.
+func GenerateUserID() (string, error) {
+	return ids.NewV7()
 }
 
-func GenerateUserID(email string) string {
-	hash := sha256.Sum256([]byte(email))
-	return fmt.Sprintf("user_%d", binary.BigEndian.Uint64(hash[:8]))
+// MigrateLegacyUserIDs replaces IDs of the old email-hash form (user_<n>)
+// with generated ones. Each old ID is kept in user_id_aliases so that
+// ResolveUserID still finds the user for clients holding a legacy ID.
+func MigrateLegacyUserIDs(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM users WHERE id ~ '^user_[0-9]+$' FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	var legacyIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacyIDs = append(legacyIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, legacyID := range legacyIDs {
+		newID, err := GenerateUserID()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE users SET id = $1 WHERE id = $2`, newID, legacyID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`INSERT INTO user_id_aliases (legacy_id, user_id) VALUES ($1, $2)`, legacyID, newID); err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`INSERT INTO audit_events (actor_id, target_id, action, outcome, metadata)
+			VALUES ('system', $1, $2, $3, jsonb_build_object('legacy_id', $4::text))`,
+			newID, audit.ActionUserIDMigrated, audit.OutcomeSuccess, legacyID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(legacyIDs), tx.Commit()
+}
+
+// ResolveUserID maps a legacy user_<n> ID to the user's current ID. Any
+// other ID is returned unchanged.
+func ResolveUserID(ctx context.Context, db *sql.DB, id string) string {
+	var current string
+	err := db.QueryRowContext(ctx, `SELECT user_id FROM user_id_aliases WHERE legacy_id = $1`, id).Scan(&current)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Println("Alias lookup failed:", err)
+		}
+		return id
+	}
+	return current
 }
 
 func HashedPassword(password string) (string, error) {
@@ -56,337 +117,501 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func RegisterUser(db *sql.DB, c *gin.Context) {
-	var user User
+// UserCreate is the body of a registration request.
+type UserCreate struct {
+	Name     string `json:"name" binding:"required,max=100"`
+	Email    string `json:"email" binding:"required,email,max=254"`
+	Password string `json:"password" binding:"required,min=8,maxbytes=72"`
+	Online   bool   `json:"online"`
+}
+
+func (u *UserCreate) normalize() {
+	u.Name = strings.TrimSpace(u.Name)
+	u.Email = normalizeEmail(u.Email)
+}
 
-	if err := c.ShouldBindJSON(&user); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func RegisterUser(users UserRepository, c *gin.Context) {
+	var req UserCreate
+	if !bindJSON(c, &req) {
 		return
 	}
+	user := User{Name: req.Name, Email: req.Email, Password: req.Password, Online: req.Online}
 	fmt.Println("Registering user with email:", user.Email)
 
-	userId := GenerateUserID(user.Email)
+	userId, err := GenerateUserID()
+	if err != nil {
+		fmt.Println("Error generating user ID:", err)
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate user ID")
+		return
+	}
 	fmt.Println("Generated user ID:", userId)
+	user.ID = userId
+	if user.Files == nil {
+		user.Files = []string{}
+	}
 
 	hashedPassword, err := HashedPassword(user.Password)
 	if err != nil {
 		fmt.Println("Error hashing password:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		problem.Abort(c, http.StatusInternalServerError, "Failed to hash password")
 		return
 	}
 	fmt.Println("Password hashed successfully")
 
-	query := `INSERT INTO users (id, name, email, password, online, files)
-		VALUES ($1, $2, $3, $4, $5, $6)`
-	_, err = db.ExecContext(c, query, userId, user.Name, user.Email, hashedPassword, user.Online, pq.Array(user.Files))
-	if err != nil {
+	user.Password = hashedPassword
+	if err := users.Create(c, &user); err != nil {
 		fmt.Println("Database insert error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		users.Record(c, audit.Event{
+			TargetID: userId,
+			Action:   audit.ActionRegister,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"email": user.Email},
+		})
+		if errors.Is(err, ErrUserExists) {
+			problem.AbortWith(c, userExistsProblem(err))
+			return
+		}
+		problem.AbortError(c, err)
 		return
 	}
 
-	access, refresh, err := middleware.GenerateTokens(userId)
+	sessionID, err := middleware.NewSessionID()
+	if err != nil {
+		problem.AbortError(c, err)
+		return
+	}
+	access, refresh, err := middleware.GenerateTokens(userId, sessionID)
 	if err != nil {
 		fmt.Println("Failed to generate tokens:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
 
-	middleware.StoreTokens(userId, access, refresh)
+	middleware.StoreTokens(userId, sessionID, access, refresh)
+	users.Record(c, audit.Event{
+		ActorID:  userId,
+		TargetID: userId,
+		Action:   audit.ActionRegister,
+		Outcome:  audit.OutcomeSuccess,
+	})
 
 	fmt.Println("User registered and logged in successfully:", userId)
 	c.JSON(http.StatusCreated, gin.H{
 		"message":      "User created and logged in!",
 		"token":        access,
 		"refreshToken": refresh,
-		"user": gin.H{
-			"id":    userId,
-			"name":  user.Name,
-			"email": user.Email,
-			// omit password hash
-			"files":  user.Files,
-			"online": user.Online,
-		},
+		"user":         selfView(user),
 	})
 }
 
 type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,maxbytes=72"`
 }
 
-func Login(db *sql.DB, c *gin.Context) {
-	var req LoginRequest
+func (r *LoginRequest) normalize() {
+	r.Email = normalizeEmail(r.Email)
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+func Login(users UserRepository, c *gin.Context) {
+	var req LoginRequest
+	if !bindJSON(c, &req) {
 		return
 	}
 	fmt.Println("Login attempt for email:", req.Email)
 
-	var user User
-	var files pq.StringArray
-	query := `SELECT id, name, email, password, online, files, created, updated FROM users WHERE email = $1`
-	err := db.QueryRowContext(c, query, req.Email).Scan(
-		&user.ID, &user.Name, &user.Email, &user.Password,
-		&user.Online, &files, &user.Created, &user.Updated,
-	)
-	user.Files = files
-	if user.Files == nil {
-		user.Files = []string{}
-	}
-	if err == sql.ErrNoRows {
+	user, purgeAfter, err := users.GetByEmail(c, req.Email)
+	if errors.Is(err, ErrUserNotFound) {
 		fmt.Println("No user found with email:", req.Email)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		users.Record(c, audit.Event{
+			Action:   audit.ActionLogin,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"email": req.Email, "reason": "unknown_email"},
+		})
+		problem.Abort(c, http.StatusNotFound, "User not found")
 		return
 	} else if err != nil {
 		fmt.Println("Database query error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		problem.AbortError(c, err)
 		return
 	}
 	fmt.Println("User found:", user.ID)
 
 	if !CheckPasswordHash(req.Password, user.Password) {
 		fmt.Println("Password verification failed for user:", user.ID)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password Verification Failed"})
+		users.Record(c, audit.Event{
+			TargetID: user.ID,
+			Action:   audit.ActionLogin,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "bad_password"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Password Verification Failed")
 		return
 	}
 	fmt.Println("Password verified for user:", user.ID)
 
-	access, refresh, err := middleware.GenerateTokens(user.ID)
+	if user.DisabledAt != nil {
+		fmt.Println("Login refused, account disabled:", user.ID)
+		users.Record(c, audit.Event{
+			TargetID: user.ID,
+			Action:   audit.ActionLogin,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "disabled"},
+		})
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeAccountDisabled, "Account is disabled")
+		return
+	}
+	if purgeAfter != nil {
+		fmt.Println("Login refused, account scheduled for deletion:", user.ID)
+		users.Record(c, audit.Event{
+			TargetID: user.ID,
+			Action:   audit.ActionLogin,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "deletion_scheduled"},
+		})
+		problem.AbortWith(c, problem.New(http.StatusForbidden, "Account is scheduled for deletion, restore it via /auth/restore").
+			WithCode(problem.CodeDeletionScheduled).
+			With("purge_after", *purgeAfter))
+		return
+	}
+
+	sessionID, err := middleware.NewSessionID()
+	if err != nil {
+		problem.AbortError(c, err)
+		return
+	}
+	access, refresh, err := middleware.GenerateTokens(user.ID, sessionID)
 	if err != nil {
 		fmt.Println("Failed to generate tokens:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate tokens"})
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate tokens")
 		return
 	}
 
-	middleware.StoreTokens(user.ID, access, refresh)
+	middleware.StoreTokens(user.ID, sessionID, access, refresh)
+	users.Record(c, audit.Event{
+		ActorID:  user.ID,
+		TargetID: user.ID,
+		Action:   audit.ActionLogin,
+		Outcome:  audit.OutcomeSuccess,
+	})
 
 	fmt.Println("Login successful for user:", user.ID)
 	c.JSON(http.StatusOK, gin.H{
 		"message":      "Login Success",
 		"token":        access,
 		"refreshToken": refresh,
-		"user": gin.H{
-			"id":    user.ID,
-			"name":  user.Name,
-			"email": user.Email,
-			// omit password hash
-			"files":  user.Files,
-			"online": user.Online,
-		},
+		"user":         selfView(user),
 	})
 }
 
-func Refresh(c *gin.Context) {
-	var body struct {
-		RefreshToken string `json:"refresh_token"`
-	}
-	if err := c.ShouldBindJSON(&body); err != nil || body.RefreshToken == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing refresh token"})
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func Refresh(users UserRepository, c *gin.Context) {
+	var body RefreshRequest
+	if !bindJSON(c, &body) {
 		return
 	}
 
 	claims, err := middleware.ValidateToken(body.RefreshToken, true)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		users.Record(c, audit.Event{
+			Action:   audit.ActionTokenRefresh,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "invalid"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid refresh token")
 		return
 	}
 
-	newAccess, _, err := middleware.GenerateTokens(claims.ID)
+	newAccess, _, err := middleware.GenerateTokens(claims.ID, claims.SessionID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate new token"})
+		problem.Abort(c, http.StatusInternalServerError, "Failed to generate new token")
+		return
+	}
+	// The new access token replaces the session's old one; the user's
+	// other sessions are unchanged.
+	if !middleware.ReplaceAccessToken(claims.ID, claims.SessionID, body.RefreshToken, newAccess) {
+		users.Record(c, audit.Event{
+			ActorID:  claims.ID,
+			Action:   audit.ActionTokenRefresh,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "revoked"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeTokenRevoked, "Refresh token revoked")
 		return
 	}
 
+	users.Record(c, audit.Event{
+		ActorID:  claims.ID,
+		TargetID: claims.ID,
+		Action:   audit.ActionTokenRefresh,
+		Outcome:  audit.OutcomeSuccess,
+	})
 	c.JSON(http.StatusOK, gin.H{"access_token": newAccess})
 }
 
-func GetUsers(db *sql.DB, c *gin.Context) {
+// includeDeleted reports whether soft-deleted users should be returned. Only
+// admins may ask for them with ?include_deleted=true.
+func includeDeleted(viewer *userViewer, c *gin.Context) bool {
+	return viewer.admin && c.Query("include_deleted") == "true"
+}
+
+func GetUsers(users UserRepository, c *gin.Context) {
 	fmt.Println("Fetching all users")
-	rows, err := db.QueryContext(c, "SELECT id, name, email, password, online, files, created, updated FROM users;")
+	viewer, err := newUserViewer(users, c)
+	if err != nil {
+		respondViewerError(c, err)
+		return
+	}
+
+	listQuery, err := parseUserListQuery(c, includeDeleted(viewer, c))
+	if err != nil {
+		problem.Abort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	// Profiles are private, so only admins may select users by them.
+	if listQuery.Profile != nil && !viewer.admin {
+		problem.Abort(c, http.StatusForbidden, "Only admins can filter by profile")
+		return
+	}
+
+	page, err := users.List(c, listQuery)
 	if err != nil {
 		fmt.Println("Query failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		problem.AbortError(c, err)
 		return
 	}
-	defer rows.Close()
 
-	var users []User
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Online, &user.Files, &user.Created, &user.Updated); err != nil {
-			fmt.Println("Row scan failed:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var nextCursor string
+	if len(page) > listQuery.Limit {
+		page = page[:listQuery.Limit]
+		nextCursor = listQuery.nextCursor(page[len(page)-1])
+	}
+
+	response := gin.H{
+		"users":       viewer.views(page),
+		"next_cursor": nextCursor,
+	}
+	if listQuery.CountTotal {
+		total, err := users.Count(c, listQuery)
+		if err != nil {
+			fmt.Println("Count query failed:", err)
+			problem.AbortError(c, err)
 			return
 		}
-		if user.Files == nil {
-			user.Files = []string{}
-		}
-		users = append(users, user)
-	}
-	if err := rows.Err(); err != nil {
-		fmt.Println("Row iteration error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		response["total"] = total
 	}
-	fmt.Println("Total users fetched:", len(users))
-	c.JSON(http.StatusOK, users)
+
+	fmt.Println("Total users fetched:", len(page))
+	c.JSON(http.StatusOK, response)
 }
 
-func GetUserByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
+func GetUserByID(users UserRepository, c *gin.Context) {
+	id := users.ResolveID(c, c.Param("id"))
 	fmt.Println("Fetching user with ID:", id)
 
-	var user User
-	query := `SELECT id, name, email, password, online, files, created, updated FROM users WHERE id = $1`
-	err := db.QueryRowContext(c, query, id).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Online, &user.Files, &user.Created, &user.Updated)
-	if err == sql.ErrNoRows {
+	viewer, err := newUserViewer(users, c)
+	if err != nil {
+		respondViewerError(c, err)
+		return
+	}
+
+	user, err := users.GetByID(c, id, includeDeleted(viewer, c))
+	if errors.Is(err, ErrUserNotFound) {
 		fmt.Println("User not found:", id)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		problem.Abort(c, http.StatusNotFound, "User not found")
 		return
 	} else if err != nil {
 		fmt.Println("Query error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		problem.AbortError(c, err)
+		return
+	}
+
+	// The body depends on who asks, so shared caches must key on the token.
+	c.Header("Vary", "Authorization")
+	etag := viewer.etag(user)
+	c.Header("ETag", etag)
+	if ifNoneMatch(c, etag) {
+		c.Status(http.StatusNotModified)
 		return
 	}
 
 	fmt.Println("User fetched:", user.ID)
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, viewer.view(user))
 }
 
-func UpdateUser(db *sql.DB, c *gin.Context) {
-	var user User
+// UserUpdate is the body of a full user update. Only the name and online
+// status can be replaced this way.
+type UserUpdate struct {
+	ID     string `json:"id" binding:"required,max=64"`
+	Name   string `json:"name" binding:"required,max=100"`
+	Online bool   `json:"online"`
+}
 
-	if err := c.ShouldBindJSON(&user); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func (u *UserUpdate) normalize() {
+	u.ID = strings.TrimSpace(u.ID)
+	u.Name = strings.TrimSpace(u.Name)
+}
+
+func UpdateUser(users UserRepository, c *gin.Context) {
+	var req UserUpdate
+	if !bindJSON(c, &req) {
 		return
 	}
+	user := User{ID: users.ResolveID(c, req.ID), Name: req.Name, Online: req.Online}
 
-	query := `UPDATE users SET name=$1, email=$2, online=$3, files=$4, updated=EXTRACT(EPOCH FROM now()) WHERE id=$5`
-	result, err := db.ExecContext(c, query, user.Name, user.Email, user.Online, user.Files, user.ID)
+	viewer, err := newUserViewer(users, c)
 	if err != nil {
-		fmt.Println("Update query failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondViewerError(c, err)
 		return
 	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		fmt.Println("Failed to retrieve rows affected:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !viewer.admin && viewer.callerID != user.ID {
+		problem.Abort(c, http.StatusForbidden, "You may only modify your own account")
 		return
 	}
 
-	if rowsAffected == 0 {
-		fmt.Println("No rows updated for ID:", user.ID)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	precondition, ok := requireIfMatch(c)
+	if !ok {
 		return
 	}
 
+	// Email is deliberately not updated here; it changes through the
+	// confirmation flow in RequestEmailChange.
+	version, err := users.Update(c, user, precondition)
+	if errors.Is(err, ErrUserExists) {
+		problem.AbortWith(c, problem.New(http.StatusConflict, "Name is already taken").WithCode(problem.CodeAlreadyExists).
+			WithErrors(problem.FieldError{Field: "/name", Code: "taken", Message: "is already taken"}))
+		return
+	} else if err != nil {
+		respondUserWriteError(c, user.ID, err)
+		return
+	}
+	c.Header("ETag", userETag(version))
+
+	users.Record(c, audit.Event{
+		ActorID:  c.GetString("userID"),
+		TargetID: user.ID,
+		Action:   audit.ActionUserUpdate,
+		Outcome:  audit.OutcomeSuccess,
+		Metadata: map[string]any{"name": user.Name},
+	})
 	fmt.Println("User updated successfully:", user.ID)
 	c.JSON(http.StatusOK, gin.H{"message": "User updated!"})
 }
 
-func DeleteUserByID(db *sql.DB, c *gin.Context) {
-	id := c.Param("id")
+func DeleteUserByID(users UserRepository, c *gin.Context) {
+	id := users.ResolveID(c, c.Param("id"))
 	fmt.Println("Deleting user with ID:", id)
 
-	query := `DELETE FROM users WHERE id = $1`
-	result, err := db.ExecContext(c, query, id)
+	viewer, err := newUserViewer(users, c)
 	if err != nil {
-		fmt.Println("Delete query failed:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondViewerError(c, err)
+		return
+	}
+	if !viewer.admin && viewer.callerID != id {
+		problem.Abort(c, http.StatusForbidden, "You may only delete your own account")
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		fmt.Println("Failed to retrieve rows affected:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	precondition, ok := requireIfMatch(c)
+	if !ok {
 		return
 	}
 
-	if rowsAffected == 0 {
-		fmt.Println("No user found to delete with ID:", id)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	// Deletion is soft so an admin can restore the account later.
+	if err := users.SoftDelete(c, id, precondition); err != nil {
+		respondUserWriteError(c, id, err)
 		return
 	}
 
+	middleware.RevokeTokens(id)
+	users.Record(c, audit.Event{
+		ActorID:  c.GetString("userID"),
+		TargetID: id,
+		Action:   audit.ActionUserDelete,
+		Outcome:  audit.OutcomeSuccess,
+	})
 	fmt.Println("User deleted successfully:", id)
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted!"})
 }
 
 type UpdatePasswordRequest struct {
-	UserID      string `json:"userId"`
-	CurrentPass string `json:"currentPassword"`
-	NewPass     string `json:"newPassword"`
+	UserID      string `json:"userId" binding:"required,max=64"`
+	CurrentPass string `json:"currentPassword" binding:"required,maxbytes=72"`
+	NewPass     string `json:"newPassword" binding:"required,min=8,maxbytes=72,nefield=CurrentPass"`
 }
 
-func UpdatePassword(db *sql.DB, c *gin.Context) {
-	var req UpdatePasswordRequest
+func (r *UpdatePasswordRequest) normalize() {
+	r.UserID = strings.TrimSpace(r.UserID)
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func UpdatePassword(users UserRepository, c *gin.Context) {
+	var req UpdatePasswordRequest
+	if !bindJSON(c, &req) {
 		return
 	}
+	req.UserID = users.ResolveID(c, req.UserID)
 
-	var storedHash string
-	query := `SELECT password FROM users WHERE id = $1`
-	err := db.QueryRowContext(c, query, req.UserID).Scan(&storedHash)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	storedHash, err := users.PasswordHash(c, req.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		problem.Abort(c, http.StatusNotFound, "User not found")
 		return
 	} else if err != nil {
 		fmt.Println("DB error fetching password:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		problem.Abort(c, http.StatusInternalServerError, "Database error")
 		return
 	}
 
 	if !CheckPasswordHash(req.CurrentPass, storedHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		users.Record(c, audit.Event{
+			ActorID:  c.GetString("userID"),
+			TargetID: req.UserID,
+			Action:   audit.ActionPasswordChange,
+			Outcome:  audit.OutcomeFailure,
+			Metadata: map[string]any{"reason": "bad_password"},
+		})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidCredentials, "Current password is incorrect")
 		return
 	}
 
 	newHash, err := HashedPassword(req.NewPass)
 	if err != nil {
 		fmt.Println("Error hashing new password:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		problem.Abort(c, http.StatusInternalServerError, "Failed to hash password")
 		return
 	}
 
-	updateQuery := `UPDATE users SET password=$1, updated=EXTRACT(EPOCH FROM now()) WHERE id=$2`
-	_, err = db.ExecContext(c, updateQuery, newHash, req.UserID)
-	if err != nil {
+	if err := users.SetPasswordHash(c, req.UserID, newHash); err != nil {
 		fmt.Println("Error updating password:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		problem.Abort(c, http.StatusInternalServerError, "Failed to update password")
 		return
 	}
 
 	middleware.RevokeTokens(req.UserID)
+	users.Record(c, audit.Event{
+		ActorID:  c.GetString("userID"),
+		TargetID: req.UserID,
+		Action:   audit.ActionPasswordChange,
+		Outcome:  audit.OutcomeSuccess,
+	})
 
 	fmt.Println("Password updated successfully and tokens revoked for user:", req.UserID)
 	c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully. Please log in again."})
 }
 
-type LogoutRequest struct {
-	Id string `json:"id"`
-}
-
-func Logout(c *gin.Context) {
-	var req LogoutRequest
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		fmt.Println("Failed to bind JSON:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
-
-	middleware.RevokeTokens(req.Id)
+// Logout ends the caller's session. Their sessions on other devices stay
+// signed in.
+func Logout(users UserRepository, c *gin.Context) {
+	userID := c.GetString("userID")
+	middleware.RevokeSession(userID, c.GetString("sessionID"))
+	users.Record(c, audit.Event{
+		ActorID:  userID,
+		TargetID: userID,
+		Action:   audit.ActionLogout,
+		Outcome:  audit.OutcomeSuccess,
+	})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully, tokens revoked"})
 }
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter mounts the user routes the way router.go does, with the
+// JWT middleware replaced by a fixed caller.
+func newTestRouter(users UserRepository, callerID string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/api", func(c *gin.Context) {
+		c.Set("userID", callerID)
+	})
+	api.GET("/users", func(c *gin.Context) { GetUsers(users, c) })
+	api.GET("/users/search", func(c *gin.Context) { SearchUsers(users, c) })
+	api.GET("/users/:id", func(c *gin.Context) { GetUserByID(users, c) })
+	api.PUT("/users", func(c *gin.Context) { UpdateUser(users, c) })
+	api.PATCH("/users/:id", func(c *gin.Context) { PatchUser(users, c) })
+	api.DELETE("/users/:id", func(c *gin.Context) { DeleteUserByID(users, c) })
+	return r
+}
+
+func newTestUsers() *MemoryUserRepository {
+	users := NewMemoryUserRepository()
+	users.Put(User{ID: "alice", Name: "Alice Example", Email: "alice@example.com", Created: 1})
+	users.Put(User{ID: "bob", Name: "Bob Builder", Email: "bob@example.com", Created: 2})
+	users.Put(User{ID: "root", Name: "Root", Email: "root@example.com", Role: "admin", Created: 3})
+	return users
+}
+
+func serve(t *testing.T, r *gin.Engine, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var out map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, w.Body)
+	}
+	return out
+}
+
+func TestGetUsers(t *testing.T) {
+	r := newTestRouter(newTestUsers(), "alice")
+
+	w := serve(t, r, http.MethodGet, "/api/users?limit=2", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	body := decode(t, w)
+	page := body["users"].([]any)
+	if len(page) != 2 || body["next_cursor"] == "" {
+		t.Fatalf("first page = %v, next_cursor %q", page, body["next_cursor"])
+	}
+	if _, ok := page[1].(map[string]any)["email"]; ok {
+		t.Errorf("another user's email is visible to a non-admin: %v", page[1])
+	}
+
+	w = serve(t, r, http.MethodGet, "/api/users?limit=2&cursor="+body["next_cursor"].(string), "", nil)
+	body = decode(t, w)
+	if page := body["users"].([]any); len(page) != 1 || page[0].(map[string]any)["id"] != "root" {
+		t.Errorf("second page = %v, want only root", page)
+	}
+	if body["next_cursor"] != "" {
+		t.Errorf("next_cursor on the last page = %q", body["next_cursor"])
+	}
+}
+
+func TestGetUsersProfileFilterNeedsAdmin(t *testing.T) {
+	r := newTestRouter(newTestUsers(), "alice")
+	if w := serve(t, r, http.MethodGet, "/api/users?profile.locale=en-GB", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+}
+
+func TestGetUserByID(t *testing.T) {
+	r := newTestRouter(newTestUsers(), "alice")
+
+	w := serve(t, r, http.MethodGet, "/api/users/alice", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"1-self-`) {
+		t.Errorf("ETag = %s, want version 1 of the self view", etag)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Authorization" {
+		t.Errorf("Vary = %q, want Authorization", vary)
+	}
+	if body := decode(t, w); body["email"] != "alice@example.com" {
+		t.Errorf("own email missing: %v", body)
+	}
+
+	w = serve(t, r, http.MethodGet, "/api/users/alice", "", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status = %d, want 304", w.Code)
+	}
+
+	// Each view and projection is its own representation.
+	for _, caller := range []string{"bob", "root"} {
+		w = serve(t, newTestRouter(newTestUsers(), caller), http.MethodGet, "/api/users/alice", "", map[string]string{"If-None-Match": etag})
+		if w.Code != http.StatusOK {
+			t.Errorf("%s with alice's own ETag: status = %d, want 200", caller, w.Code)
+		}
+	}
+	w = serve(t, r, http.MethodGet, "/api/users/alice?fields=name,id", "", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Errorf("?fields= with the full view's ETag: status = %d, want 200", w.Code)
+	}
+	fieldsETag := w.Header().Get("ETag")
+	w = serve(t, r, http.MethodGet, "/api/users/alice?fields=id,name,id", "", map[string]string{"If-None-Match": fieldsETag})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("reordered ?fields= status = %d, want 304", w.Code)
+	}
+
+	if w := serve(t, r, http.MethodGet, "/api/users/nobody", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing user status = %d, want 404", w.Code)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		body   string
+		header map[string]string
+		want   int
+	}{
+		{"own account", "alice", `{"id":"alice","name":"Alice B"}`, map[string]string{"If-Match": `"1"`}, http.StatusOK},
+		{"admin", "root", `{"id":"alice","name":"Alice B"}`, map[string]string{"If-Match": `"1"`}, http.StatusOK},
+		{"other account", "bob", `{"id":"alice","name":"Alice B"}`, map[string]string{"If-Match": `"1"`}, http.StatusForbidden},
+		{"missing If-Match", "alice", `{"id":"alice","name":"Alice B"}`, nil, http.StatusPreconditionRequired},
+		{"stale If-Match", "alice", `{"id":"alice","name":"Alice B"}`, map[string]string{"If-Match": `"7"`}, http.StatusPreconditionFailed},
+		{"missing user", "root", `{"id":"nobody","name":"Nobody"}`, map[string]string{"If-Match": "*"}, http.StatusNotFound},
+		{"name taken", "alice", `{"id":"alice","name":"Bob Builder"}`, map[string]string{"If-Match": "*"}, http.StatusConflict},
+		{"invalid body", "alice", `{"id":"alice"}`, map[string]string{"If-Match": "*"}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestUsers(), tt.caller)
+			w := serve(t, r, http.MethodPut, "/api/users", tt.body, tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			switch tt.want {
+			case http.StatusOK:
+				if etag := w.Header().Get("ETag"); etag != `"2"` {
+					t.Errorf("ETag = %s, want \"2\"", etag)
+				}
+			case http.StatusPreconditionFailed:
+				if etag := w.Header().Get("ETag"); etag != `"1"` {
+					t.Errorf("412 ETag = %s, want the current \"1\"", etag)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	const merge = "application/merge-patch+json"
+	tests := []struct {
+		name   string
+		caller string
+		id     string
+		body   string
+		header map[string]string
+		want   int
+	}{
+		{"own name", "alice", "alice", `{"name":"Alice B"}`, map[string]string{"If-Match": `"1"`}, http.StatusOK},
+		{"view ETag as If-Match", "alice", "alice", `{"name":"Alice B"}`, map[string]string{"If-Match": `"1-self-e3b0c442"`}, http.StatusOK},
+		{"admin sets role", "root", "alice", `{"role":"admin"}`, map[string]string{"If-Match": `"1"`}, http.StatusOK},
+		{"own role", "alice", "alice", `{"role":"admin"}`, map[string]string{"If-Match": `"1"`}, http.StatusForbidden},
+		{"other account", "bob", "alice", `{"name":"Alice B"}`, map[string]string{"If-Match": `"1"`}, http.StatusForbidden},
+		{"missing If-Match", "alice", "alice", `{"name":"Alice B"}`, nil, http.StatusPreconditionRequired},
+		{"stale If-Match", "alice", "alice", `{"name":"Alice B"}`, map[string]string{"If-Match": `"7"`}, http.StatusPreconditionFailed},
+		{"missing user", "root", "nobody", `{"name":"Nobody"}`, map[string]string{"If-Match": "*"}, http.StatusNotFound},
+		{"name taken", "alice", "alice", `{"name":"Bob Builder"}`, map[string]string{"If-Match": "*"}, http.StatusConflict},
+		{"JSON Patch", "alice", "alice", `[{"op":"replace","path":"/online","value":true}]`,
+			map[string]string{"If-Match": "*", "Content-Type": "application/json-patch+json"}, http.StatusOK},
+		{"wrong Content-Type", "alice", "alice", `{"name":"Alice B"}`,
+			map[string]string{"If-Match": "*", "Content-Type": "application/json"}, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := newTestUsers()
+			r := newTestRouter(users, tt.caller)
+			header := map[string]string{"Content-Type": merge}
+			for k, v := range tt.header {
+				header[k] = v
+			}
+			w := serve(t, r, http.MethodPatch, "/api/users/"+tt.id, tt.body, header)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusPreconditionFailed && w.Header().Get("ETag") != `"1"` {
+				t.Errorf("412 ETag = %s, want the current \"1\"", w.Header().Get("ETag"))
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if etag := w.Header().Get("ETag"); !strings.HasPrefix(etag, `"2-`) {
+				t.Errorf("ETag = %s, want version 2", etag)
+			}
+			if len(users.Events()) != 1 {
+				t.Errorf("audit events = %v, want one", users.Events())
+			}
+		})
+	}
+}
+
+func TestPatchUserAppliesChange(t *testing.T) {
+	users := newTestUsers()
+	r := newTestRouter(users, "root")
+	w := serve(t, r, http.MethodPatch, "/api/users/alice", `{"name":"Alice B","role":"admin"}`,
+		map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": `"1"`})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if body := decode(t, w); body["name"] != "Alice B" || body["role"] != "admin" {
+		t.Errorf("response = %v", body)
+	}
+	user, _ := users.GetByID(context.Background(), "alice", false)
+	if user.Name != "Alice B" || user.Role != "admin" || user.Version != 2 {
+		t.Errorf("stored user = %+v", user)
+	}
+}
+
+func TestDeleteUserByID(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller string
+		id     string
+		header map[string]string
+		want   int
+	}{
+		{"own account", "alice", "alice", map[string]string{"If-Match": `"1"`}, http.StatusOK},
+		{"admin", "root", "alice", map[string]string{"If-Match": "*"}, http.StatusOK},
+		{"other account", "bob", "alice", map[string]string{"If-Match": "*"}, http.StatusForbidden},
+		{"missing If-Match", "alice", "alice", nil, http.StatusPreconditionRequired},
+		{"stale If-Match", "alice", "alice", map[string]string{"If-Match": `"7"`}, http.StatusPreconditionFailed},
+		{"missing user", "root", "nobody", map[string]string{"If-Match": "*"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := newTestUsers()
+			r := newTestRouter(users, tt.caller)
+			w := serve(t, r, http.MethodDelete, "/api/users/"+tt.id, "", tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			_, err := users.GetByID(context.Background(), "alice", false)
+			if deleted := err != nil; deleted != (tt.want == http.StatusOK) {
+				t.Errorf("alice deleted = %v after status %d", deleted, w.Code)
+			}
+		})
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	users := newTestUsers()
+
+	w := serve(t, newTestRouter(users, "alice"), http.MethodGet, "/api/users/search?q=bob", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if hits := decode(t, w)["hits"].([]any); len(hits) != 1 {
+		t.Errorf("hits for bob = %v, want one", hits)
+	}
+
+	// Only admins match on email.
+	w = serve(t, newTestRouter(users, "alice"), http.MethodGet, "/api/users/search?q=example", "", nil)
+	if hits := decode(t, w)["hits"].([]any); len(hits) != 1 {
+		t.Errorf("non-admin hits for example = %v, want only Alice Example", hits)
+	}
+	w = serve(t, newTestRouter(users, "root"), http.MethodGet, "/api/users/search?q=example", "", nil)
+	if hits := decode(t, w)["hits"].([]any); len(hits) != 3 {
+		t.Errorf("admin hits for example = %v, want all three", hits)
+	}
+
+	if w := serve(t, newTestRouter(users, "alice"), http.MethodGet, "/api/users/search?q=%21%21", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("punctuation-only q status = %d, want 400", w.Code)
+	}
+}
+
+func TestSearchUsersPages(t *testing.T) {
+	users := newTestUsers()
+	r := newTestRouter(users, "root")
+
+	var seen []string
+	cursor := ""
+	for range 4 {
+		w := serve(t, r, http.MethodGet, "/api/users/search?q=example&limit=1&cursor="+cursor, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+		}
+		body := decode(t, w)
+		for _, hit := range body["hits"].([]any) {
+			seen = append(seen, hit.(map[string]any)["user"].(map[string]any)["id"].(string))
+		}
+		if cursor = body["next_cursor"].(string); cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 3 || seen[0] == seen[1] || seen[1] == seen[2] || seen[0] == seen[2] {
+		t.Errorf("paged hits = %v, want each user once", seen)
+	}
+}
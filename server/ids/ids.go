@@ -0,0 +1,65 @@
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// The fields of the previous ID, so the next one can be made to sort
+	// after it.
+	lastMu    sync.Mutex
+	lastMilli uint64
+	lastRandA uint16 // 12 bits
+	lastRandB uint64 // 62 bits
+)
+
+// NewV7 returns an RFC 9562 version 7 UUID. The leading millisecond
+// timestamp keeps new IDs roughly ordered, which is kinder to B-tree indexes
+// than fully random v4 IDs. The remaining 74 bits are random for the first ID
+// of each millisecond.
+//
+// IDs from this process are strictly increasing: within a millisecond, or if
+// the clock steps back, the new ID is the previous one plus a random
+// increment of up to 2^32 instead (RFC 9562, section 6.2, method 2). Sorting
+// by ID therefore sorts by creation order, not just by millisecond, while
+// IDs made together still cannot be guessed from one another.
+func NewV7() (string, error) {
+	var r [14]byte
+	if _, err := rand.Read(r[:]); err != nil {
+		return "", err
+	}
+	milli := uint64(time.Now().UnixMilli())
+	randA := binary.BigEndian.Uint16(r[0:2]) & 0x0fff
+	randB := binary.BigEndian.Uint64(r[2:10]) & (1<<62 - 1)
+
+	lastMu.Lock()
+	if milli <= lastMilli {
+		// randA and randB form one 74-bit counter; a carry out of it moves
+		// on to the next millisecond.
+		increment := uint64(binary.BigEndian.Uint32(r[10:14])) + 1
+		milli, randA, randB = lastMilli, lastRandA, lastRandB+increment
+		if randB >= 1<<62 {
+			randB -= 1 << 62
+			randA++
+			if randA == 1<<12 {
+				randA = 0
+				milli++
+			}
+		}
+	}
+	lastMilli, lastRandA, lastRandB = milli, randA, randB
+	lastMu.Unlock()
+
+	var b [16]byte
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], milli)
+	copy(b[0:6], ts[2:8])
+	binary.BigEndian.PutUint16(b[6:8], 0x7000|randA)              // version 7
+	binary.BigEndian.PutUint64(b[8:16], 0x8000000000000000|randB) // RFC 9562 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
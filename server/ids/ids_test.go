@@ -0,0 +1,86 @@
+package ids
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var v7Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewV7IsMonotonic(t *testing.T) {
+	prev := ""
+	for i := 0; i < 10000; i++ {
+		id, err := NewV7()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v7Pattern.MatchString(id) {
+			t.Fatalf("NewV7() = %q, not a version 7 UUID", id)
+		}
+		if id <= prev {
+			t.Fatalf("NewV7() = %q after %q, want increasing IDs", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestNewV7CarriesIntoTimestamp(t *testing.T) {
+	lastMu.Lock()
+	// A far-future timestamp forces the increment path.
+	lastMilli, lastRandA, lastRandB = 1<<47, 1<<12-1, 1<<62-1
+	lastMu.Unlock()
+	defer func() {
+		lastMu.Lock()
+		lastMilli, lastRandA, lastRandB = 0, 0, 0
+		lastMu.Unlock()
+	}()
+
+	id, err := NewV7()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The random increment carries into the next millisecond.
+	if want := "80000000-0001-7000-"; !strings.HasPrefix(id, want) {
+		t.Errorf("NewV7() after the largest ID of a millisecond = %q, want prefix %q", id, want)
+	}
+}
+
+func TestNewV7IncrementIsRandom(t *testing.T) {
+	lastMu.Lock()
+	// A far-future timestamp forces every ID onto the increment path.
+	lastMilli, lastRandA, lastRandB = 1<<47, 0, 0
+	lastMu.Unlock()
+	defer func() {
+		lastMu.Lock()
+		lastMilli, lastRandA, lastRandB = 0, 0, 0
+		lastMu.Unlock()
+	}()
+
+	// lowBits reads rand_b, the 62 bits after the variant.
+	lowBits := func(id string) uint64 {
+		hex := strings.ReplaceAll(id[19:], "-", "")
+		v, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v & (1<<62 - 1)
+	}
+	prev, err := NewV7()
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := map[uint64]bool{}
+	for i := 0; i < 100; i++ {
+		id, err := NewV7()
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps[lowBits(id)-lowBits(prev)] = true
+		prev = id
+	}
+	if len(steps) < 90 {
+		t.Errorf("%d distinct steps between 101 IDs, want the increments to be random", len(steps))
+	}
+}
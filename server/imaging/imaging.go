@@ -0,0 +1,159 @@
+// Package imaging decodes uploaded images and renders square thumbnails
+// from them. Decoding uses the standard library, plus golang.org/x/image for
+// WebP.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Accepted maps the content types that uploads may have, as sniffed from
+// their first bytes, to the names image.Decode reports for them.
+var Accepted = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/webp": "webp",
+}
+
+// ErrUnsupported is returned for data that is not an accepted image type.
+var ErrUnsupported = errors.New("unsupported image type")
+
+// Image is a decoded upload.
+type Image struct {
+	image.Image
+	// ContentType is the sniffed type of the original data.
+	ContentType string
+	// Orientation is the EXIF orientation (1-8) of a JPEG, 1 otherwise.
+	Orientation int
+}
+
+// Decode sniffs and decodes data. Images with more than maxPixels pixels are
+// rejected before their pixels are decoded. Nothing but the pixels is kept,
+// so metadata never survives re-encoding.
+func Decode(data []byte, maxPixels int) (*Image, error) {
+	contentType := http.DetectContentType(data)
+	format, ok := Accepted[contentType]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	config, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if decoded != format {
+		return nil, ErrUnsupported
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxPixels/config.Height {
+		return nil, fmt.Errorf("image is %dx%d, larger than %d pixels", config.Width, config.Height, maxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	return &Image{Image: img, ContentType: contentType, Orientation: orientation}, nil
+}
+
+// Opaque reports whether every pixel of img is fully opaque.
+func Opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// Thumbnail crops the centre square of img and scales it to size x size.
+// Each output pixel is the average of the source pixels it covers, so
+// downscaling does not alias. The EXIF orientation is applied to the result.
+func Thumbnail(img *Image, size int) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	crop := image.Rect(0, 0, side, side).Add(b.Min).Add(image.Pt((b.Dx()-side)/2, (b.Dy()-side)/2))
+
+	// The crop is converted to RGBA one band of source rows at a time, the
+	// rows a single output row covers, so large images are never copied
+	// whole.
+	band := image.NewRGBA(image.Rect(0, 0, side, side/size+1))
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0, sy1 := span(dy, size, side)
+		draw.Draw(band, image.Rect(0, 0, side, sy1-sy0), img, crop.Min.Add(image.Pt(0, sy0)), draw.Src)
+		for dx := 0; dx < size; dx++ {
+			sx0, sx1 := span(dx, size, side)
+			var r, g, bl, a, n int
+			for sy := 0; sy < sy1-sy0; sy++ {
+				row := band.Pix[sy*band.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			p := dst.Pix[dy*dst.Stride+dx*4:]
+			p[0], p[1], p[2], p[3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return orient(dst, img.Orientation)
+}
+
+// span returns the source pixels [lo, hi) covered by output pixel i when
+// scaling side pixels to size. When upscaling it covers the nearest one.
+func span(i, size, side int) (int, int) {
+	lo := i * side / size
+	hi := (i + 1) * side / size
+	if hi <= lo {
+		hi = lo + 1
+	}
+	return lo, hi
+}
+
+// orient returns the square img transformed for display according to an
+// EXIF orientation value.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	n := img.Bounds().Dx()
+	last := n - 1
+	out := image.NewRGBA(img.Bounds())
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = last-x, y
+			case 3: // rotated 180
+				sx, sy = last-x, last-y
+			case 4: // mirrored vertically
+				sx, sy = x, last-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a clockwise turn
+				sx, sy = y, last-x
+			case 7: // transversed
+				sx, sy = last-y, last-x
+			case 8: // needs an anticlockwise turn
+				sx, sy = last-y, x
+			}
+			copy(out.Pix[y*out.Stride+x*4:y*out.Stride+x*4+4], img.Pix[sy*img.Stride+sx*4:])
+		}
+	}
+	return out
+}
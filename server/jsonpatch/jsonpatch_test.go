@@ -0,0 +1,209 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("decoding %s: %v", s, err)
+	}
+	return v
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string // empty when the patch must fail
+	}{
+		// RFC 6902, Appendix A.
+		{"A.1 add an object member", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/baz","value":"qux"}]`,
+			`{"baz":"qux","foo":"bar"}`},
+		{"A.2 add an array element", `{"foo":["bar","baz"]}`,
+			`[{"op":"add","path":"/foo/1","value":"qux"}]`,
+			`{"foo":["bar","qux","baz"]}`},
+		{"A.3 remove an object member", `{"baz":"qux","foo":"bar"}`,
+			`[{"op":"remove","path":"/baz"}]`,
+			`{"foo":"bar"}`},
+		{"A.4 remove an array element", `{"foo":["bar","qux","baz"]}`,
+			`[{"op":"remove","path":"/foo/1"}]`,
+			`{"foo":["bar","baz"]}`},
+		{"A.5 replace a value", `{"baz":"qux","foo":"bar"}`,
+			`[{"op":"replace","path":"/baz","value":"boo"}]`,
+			`{"baz":"boo","foo":"bar"}`},
+		{"A.6 move a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"A.7 move an array element", `{"foo":["all","grass","cows","eat"]}`,
+			`[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{"A.8 test a value", `{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{"A.9 test a value, error", `{"baz":"qux"}`,
+			`[{"op":"test","path":"/baz","value":"bar"}]`,
+			``},
+		{"A.10 add a nested member object", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			`{"foo":"bar","child":{"grandchild":{}}}`},
+		{"A.11 ignore unrecognized elements", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/baz","value":"qux","xyz":123}]`,
+			`{"foo":"bar","baz":"qux"}`},
+		{"A.12 add to a nonexistent target", `{"foo":"bar"}`,
+			`[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+			``},
+		{"A.14 ~ escape ordering", `{"/":9,"~1":10}`,
+			`[{"op":"test","path":"/~01","value":10}]`,
+			`{"/":9,"~1":10}`},
+		{"A.15 compare strings and numbers", `{"/":9,"~1":10}`,
+			`[{"op":"test","path":"/~01","value":"10"}]`,
+			``},
+		{"A.16 add an array value", `{"foo":["bar"]}`,
+			`[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+			`{"foo":["bar",["abc","def"]]}`},
+
+		// Array indexes.
+		{"- appends", `{"a":[1,2]}`,
+			`[{"op":"add","path":"/a/-","value":3}]`,
+			`{"a":[1,2,3]}`},
+		{"- only names a new element", `{"a":[1,2]}`,
+			`[{"op":"replace","path":"/a/-","value":3}]`,
+			``},
+		{"add at the length appends", `{"a":[1,2]}`,
+			`[{"op":"add","path":"/a/2","value":3}]`,
+			`{"a":[1,2,3]}`},
+		{"add past the length", `{"a":[1,2]}`,
+			`[{"op":"add","path":"/a/3","value":3}]`,
+			``},
+		{"leading zero index", `{"a":[1,2]}`,
+			`[{"op":"replace","path":"/a/01","value":3}]`,
+			``},
+		{"zero index", `{"a":[1,2]}`,
+			`[{"op":"replace","path":"/a/0","value":3}]`,
+			`{"a":[3,2]}`},
+		{"negative index", `{"a":[1,2]}`,
+			`[{"op":"remove","path":"/a/-1"}]`,
+			``},
+
+		// Pointer escapes.
+		{"~1 is a slash", `{"a/b":1}`,
+			`[{"op":"replace","path":"/a~1b","value":2}]`,
+			`{"a/b":2}`},
+		{"~0 is a tilde", `{"m~n":1}`,
+			`[{"op":"remove","path":"/m~0n"}]`,
+			`{}`},
+		{"pointer without a leading slash", `{"a":1}`,
+			`[{"op":"remove","path":"a"}]`,
+			``},
+
+		// move and copy.
+		{"move into its own child", `{"a":{"b":{}}}`,
+			`[{"op":"move","from":"/a","path":"/a/b/c"}]`,
+			``},
+		{"move onto itself", `{"a":{"b":1}}`,
+			`[{"op":"move","from":"/a","path":"/a"}]`,
+			`{"a":{"b":1}}`},
+		{"copy is independent of its source", `{"a":{"b":1}}`,
+			`[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`,
+			`{"a":{"b":1},"c":{"b":2}}`},
+
+		// The whole document.
+		{"remove the root", `{"a":1}`,
+			`[{"op":"remove","path":""}]`,
+			``},
+		{"replace the root", `{"a":1}`,
+			`[{"op":"replace","path":"","value":[1]}]`,
+			`[1]`},
+		{"test the root", `{"a":1}`,
+			`[{"op":"test","path":"","value":{"a":1}}]`,
+			`{"a":1}`},
+
+		// Malformed operations.
+		{"unknown op", `{}`,
+			`[{"op":"frobnicate","path":"/a"}]`,
+			``},
+		{"missing value", `{}`,
+			`[{"op":"add","path":"/a"}]`,
+			``},
+		{"null value", `{}`,
+			`[{"op":"add","path":"/a","value":null}]`,
+			`{"a":null}`},
+		{"replace a missing member", `{}`,
+			`[{"op":"replace","path":"/a","value":1}]`,
+			``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := decodeJSON(t, tt.doc)
+			var ops []Operation
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Apply(doc, ops)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Apply = %v, want an error", got)
+				}
+			} else if err != nil {
+				t.Fatalf("Apply: %v", err)
+			} else if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("Apply = %v, want %v", got, want)
+			}
+
+			// Apply never changes its input, even when it fails part way.
+			if original := decodeJSON(t, tt.doc); !reflect.DeepEqual(doc, original) {
+				t.Errorf("input changed to %v", doc)
+			}
+		})
+	}
+}
+
+func TestApplyTestFailure(t *testing.T) {
+	ops := []Operation{
+		{Op: "replace", Path: "/a", Value: json.RawMessage(`2`)},
+		{Op: "test", Path: "/b", Value: json.RawMessage(`"x"`)},
+	}
+	_, err := Apply(map[string]any{"a": 1.0, "b": "y"}, ops)
+	if !errors.Is(err, ErrTestFailed) {
+		t.Errorf("err = %v, want ErrTestFailed", err)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// RFC 7396, Appendix A, plus a nested deletion.
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`{"a":{"b":{"c":1,"d":2}}}`, `{"a":{"b":{"c":null}}}`, `{"a":{"b":{"d":2}}}`},
+	}
+	for _, tt := range tests {
+		got := MergePatch(decodeJSON(t, tt.target), decodeJSON(t, tt.patch))
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("MergePatch(%s, %s) = %v, want %s", tt.target, tt.patch, got, tt.want)
+		}
+	}
+}
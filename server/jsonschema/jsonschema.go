@@ -0,0 +1,321 @@
+// Package jsonschema validates decoded JSON against a subset of JSON Schema
+// (draft 2020-12): type, enum, const, properties, required,
+// additionalProperties, maxProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, format, minimum and maximum. Other
+// keywords are ignored, as the specification asks of unknown ones.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+// Schema is a compiled schema.
+type Schema struct {
+	Type                 []string           `json:"-"`
+	Enum                 []any              `json:"enum"`
+	Const                *any               `json:"-"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *Schema            `json:"-"`
+	MaxProperties        *int               `json:"maxProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	Format               string             `json:"format"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+
+	// deny is set for the schema false, which nothing matches.
+	deny    bool
+	pattern *regexp.Regexp
+}
+
+// ValidationError says where a value broke the schema. Path is a JSON
+// Pointer (RFC 6901) into the validated value.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+var types = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// Compile parses a schema document.
+func Compile(raw []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		s.deny = !b
+		return nil
+	}
+
+	// The alias has the same fields without this method.
+	type plain Schema
+	if err := json.Unmarshal(data, (*plain)(s)); err != nil {
+		return err
+	}
+	var extra struct {
+		Type                 json.RawMessage `json:"type"`
+		Const                json.RawMessage `json:"const"`
+		AdditionalProperties *Schema         `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+	s.AdditionalProperties = extra.AdditionalProperties
+
+	if len(extra.Type) > 0 {
+		if err := json.Unmarshal(extra.Type, &s.Type); err != nil {
+			var one string
+			if err := json.Unmarshal(extra.Type, &one); err != nil {
+				return fmt.Errorf("type must be a string or an array of strings")
+			}
+			s.Type = []string{one}
+		}
+		for _, t := range s.Type {
+			if !types[t] {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	}
+	if len(extra.Const) > 0 {
+		var v any
+		if err := json.Unmarshal(extra.Const, &v); err != nil {
+			return err
+		}
+		s.Const = &v
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	if s.Format != "" && formats[s.Format] == nil {
+		return fmt.Errorf("unknown format %q", s.Format)
+	}
+	return nil
+}
+
+// Lookup returns the schema for the value at the object keys in path, or
+// nil if there is none because the value is forbidden or unconstrained.
+func (s *Schema) Lookup(path ...string) *Schema {
+	for _, key := range path {
+		if s == nil || s.deny {
+			return nil
+		}
+		if child, ok := s.Properties[key]; ok {
+			s = child
+		} else {
+			s = s.AdditionalProperties
+		}
+	}
+	if s == nil || s.deny {
+		return nil
+	}
+	return s
+}
+
+// Validate checks a value decoded by encoding/json against the schema and
+// returns every violation, ordered by path.
+func (s *Schema) Validate(value any) []ValidationError {
+	var errs []ValidationError
+	s.validate(value, "", &errs)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	return errs
+}
+
+func (s *Schema) validate(value any, path string, errs *[]ValidationError) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.deny {
+		fail("is not allowed")
+		return
+	}
+	if len(s.Type) > 0 && !s.hasType(value) {
+		fail("must be of type %s", strings.Join(s.Type, " or "))
+		return
+	}
+	if s.Const != nil && !equal(value, *s.Const) {
+		fail("must be %s", encode(*s.Const))
+	}
+	if len(s.Enum) > 0 && !contains(s.Enum, value) {
+		options := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			options[i] = encode(e)
+		}
+		fail("must be one of %s", strings.Join(options, ", "))
+	}
+
+	switch v := value.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %s", s.Pattern)
+		}
+		if s.Format != "" && !formats[s.Format](v) {
+			fail("must be a valid %s", s.Format)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %s", formatNumber(*s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %s", formatNumber(*s.Maximum))
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, path+"/"+strconv.Itoa(i), errs)
+			}
+		}
+	case map[string]any:
+		if s.MaxProperties != nil && len(v) > *s.MaxProperties {
+			fail("must have at most %d properties", *s.MaxProperties)
+		}
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				*errs = append(*errs, ValidationError{Path: path + "/" + escape(key), Message: "is required"})
+			}
+		}
+		for key, item := range v {
+			child, ok := s.Properties[key]
+			if !ok {
+				child = s.AdditionalProperties
+			}
+			if child != nil {
+				child.validate(item, path+"/"+escape(key), errs)
+			}
+		}
+	}
+}
+
+func (s *Schema) hasType(value any) bool {
+	for _, t := range s.Type {
+		switch v := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || (t == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case []any:
+			if t == "array" {
+				return true
+			}
+		case map[string]any:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formats are the supported values of the format keyword.
+var formats = map[string]func(string) bool{
+	"email": func(s string) bool {
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s
+	},
+	"uri": func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && u.IsAbs()
+	},
+	"date": func(s string) bool {
+		_, err := time.Parse(time.DateOnly, s)
+		return err == nil
+	},
+	"date-time": func(s string) bool {
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	},
+	// timezone is not a standard format: an IANA time zone name such as
+	// Europe/Berlin.
+	"timezone": func(s string) bool {
+		if s == "" || s == "Local" {
+			return false
+		}
+		_, err := time.LoadLocation(s)
+		return err == nil
+	},
+}
+
+func equal(a, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func contains(values []any, v any) bool {
+	for _, e := range values {
+		if equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// escape encodes a key as a JSON Pointer reference token.
+func escape(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,157 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func compile(t *testing.T, schema string) *Schema {
+	t.Helper()
+	s, err := Compile([]byte(schema))
+	if err != nil {
+		t.Fatalf("Compile(%s): %v", schema, err)
+	}
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		// want lists the paths of the expected errors, in order.
+		want []string
+	}{
+		{"type", `{"type":"string"}`, `"a"`, nil},
+		{"wrong type", `{"type":"string"}`, `1`, []string{""}},
+		{"type union", `{"type":["string","null"]}`, `null`, nil},
+		{"type union mismatch", `{"type":["string","null"]}`, `true`, []string{""}},
+		{"integer", `{"type":"integer"}`, `3`, nil},
+		{"integer with a fraction", `{"type":"integer"}`, `3.5`, []string{""}},
+		{"number includes integers", `{"type":"number"}`, `3`, nil},
+
+		{"enum", `{"enum":["light","dark"]}`, `"dark"`, nil},
+		{"not in enum", `{"enum":["light","dark"]}`, `"blue"`, []string{""}},
+		{"enum compares types", `{"enum":[1,"2"]}`, `2`, []string{""}},
+		{"const", `{"const":{"a":[1]}}`, `{"a":[1]}`, nil},
+		{"const mismatch", `{"const":{"a":[1]}}`, `{"a":[2]}`, []string{""}},
+		{"const null", `{"const":null}`, `null`, nil},
+		{"const null mismatch", `{"const":null}`, `0`, []string{""}},
+
+		{"maxLength counts runes", `{"maxLength":3}`, `"äöü"`, nil},
+		{"maxLength exceeded", `{"maxLength":3}`, `"äöüß"`, []string{""}},
+		{"minLength", `{"minLength":2}`, `"é"`, []string{""}},
+		{"pattern", `{"pattern":"^[a-z]{2}(-[A-Z]{2})?$"}`, `"en-GB"`, nil},
+		{"pattern mismatch", `{"pattern":"^[a-z]{2}(-[A-Z]{2})?$"}`, `"english"`, []string{""}},
+		{"pattern is unanchored", `{"pattern":"b"}`, `"abc"`, nil},
+
+		{"minimum and maximum", `{"minimum":1,"maximum":5}`, `5`, nil},
+		{"below minimum", `{"minimum":1,"maximum":5}`, `0.5`, []string{""}},
+		{"above maximum", `{"minimum":1,"maximum":5}`, `6`, []string{""}},
+
+		{"items", `{"items":{"type":"string"},"maxItems":2}`, `["a",1]`, []string{"/1"}},
+		{"too many items", `{"maxItems":1}`, `[1,2]`, []string{""}},
+		{"too few items", `{"minItems":1}`, `[]`, []string{""}},
+
+		{"required", `{"required":["a","b"]}`, `{"a":1}`, []string{"/b"}},
+		{"properties", `{"properties":{"a":{"type":"string"}}}`, `{"a":1,"b":2}`, []string{"/a"}},
+		{"additionalProperties false", `{"properties":{"a":{}},"additionalProperties":false}`,
+			`{"a":1,"b":2,"c":3}`, []string{"/b", "/c"}},
+		{"additionalProperties schema", `{"additionalProperties":{"type":"boolean"}}`,
+			`{"x":true,"y":"no"}`, []string{"/y"}},
+		{"maxProperties", `{"maxProperties":1}`, `{"a":1,"b":2}`, []string{""}},
+		{"nested paths are escaped", `{"properties":{"a/b":{"properties":{"c~d":{"type":"string"}}}}}`,
+			`{"a/b":{"c~d":1}}`, []string{"/a~1b/c~0d"}},
+		{"false schema", `false`, `1`, []string{""}},
+		{"true schema", `true`, `{"anything":[1]}`, nil},
+		{"unknown keywords are ignored", `{"description":"x","$comment":"y"}`, `1`, nil},
+
+		{"email", `{"format":"email"}`, `"a@example.com"`, nil},
+		{"email with a display name", `{"format":"email"}`, `"A <a@example.com>"`, []string{""}},
+		{"uri", `{"format":"uri"}`, `"https://example.com/a"`, nil},
+		{"relative uri", `{"format":"uri"}`, `"/a"`, []string{""}},
+		{"date", `{"format":"date"}`, `"2024-02-29"`, nil},
+		{"invalid date", `{"format":"date"}`, `"2023-02-29"`, []string{""}},
+		{"date-time", `{"format":"date-time"}`, `"2024-02-29T12:00:00Z"`, nil},
+		{"format applies only to strings", `{"format":"date"}`, `1`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value any
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range compile(t, tt.schema).Validate(value) {
+				got = append(got, e.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("error paths = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimezoneFormat(t *testing.T) {
+	s := compile(t, `{"type":"string","format":"timezone"}`)
+	for _, tz := range []string{"Europe/Berlin", "America/Argentina/Buenos_Aires", "UTC"} {
+		if errs := s.Validate(tz); len(errs) > 0 {
+			t.Errorf("%q: %v, want valid", tz, errs)
+		}
+	}
+	for _, tz := range []string{"", "Local", "Mars/Olympus_Mons", "../../etc/passwd", "/etc/localtime",
+		"Europe/../Europe/Berlin", `..\Europe\Berlin`} {
+		if errs := s.Validate(tz); len(errs) == 0 {
+			t.Errorf("%q: valid, want an error", tz)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{`{"pattern":"("}`, "pattern"},
+		{`{"properties":{"a":{"pattern":"[z-a]"}}}`, "pattern"},
+		{`{"type":"text"}`, "unknown type"},
+		{`{"type":["string",1]}`, "type must be"},
+		{`{"format":"colour"}`, "unknown format"},
+		{`{"minLength":"1"}`, "minLength"},
+		{`[`, "unexpected end"},
+	}
+	for _, tt := range tests {
+		_, err := Compile([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Compile(%s) = %v, want an error mentioning %q", tt.schema, err, tt.want)
+		}
+	}
+}
+
+func TestValidationErrorMessages(t *testing.T) {
+	s := compile(t, `{"type":"object","properties":{"theme":{"enum":["light","dark"]},"name":{"maxLength":2}}}`)
+	got := s.Validate(map[string]any{"theme": "blue", "name": "abc"})
+	want := []ValidationError{
+		{Path: "/name", Message: "must be at most 2 characters"},
+		{Path: "/theme", Message: `must be one of "light", "dark"`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate = %v, want %v", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := compile(t, `{"properties":{"a":{"properties":{"b":{"type":"string"}},"additionalProperties":false}},
+		"additionalProperties":{"type":"number"}}`)
+	if got := s.Lookup("a", "b"); got == nil || !reflect.DeepEqual(got.Type, []string{"string"}) {
+		t.Errorf("Lookup(a, b) = %+v, want the string schema", got)
+	}
+	if got := s.Lookup("a", "c"); got != nil {
+		t.Errorf("Lookup(a, c) = %+v, want nil for a forbidden key", got)
+	}
+	if got := s.Lookup("x"); got == nil || !reflect.DeepEqual(got.Type, []string{"number"}) {
+		t.Errorf("Lookup(x) = %+v, want the additionalProperties schema", got)
+	}
+}
@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Send delivers a plain text email through the SMTP server configured by
+// SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM. When
+// SMTP_HOST is unset the message is logged instead so local setups work
+// without a mail server.
+func Send(to, subject, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Printf("[MAIL] to=%s subject=%q\n%s", to, subject, body)
+		return nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		return fmt.Errorf("SMTP_FROM is not set")
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	return smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg))
+}
+
+// PublicURL returns the externally reachable base URL used to build links
+// in emails, without a trailing slash.
+func PublicURL() string {
+	url := os.Getenv("PUBLIC_URL")
+	if url == "" {
+		url = "http://localhost"
+	}
+	return strings.TrimRight(url, "/")
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var (
+	ErrAccountNotFound = errors.New("account not found")
+	ErrAccountDeleted  = errors.New("account deleted")
+	ErrAccountDisabled = errors.New("account disabled")
+	ErrAccountDeleting = errors.New("account scheduled for deletion")
+)
+
+// CheckAccountStatus returns nil if the user exists and may use the API, or
+// one of the ErrAccount errors explaining why not.
+func CheckAccountStatus(ctx context.Context, db *sql.DB, userID string) error {
+	var deletedAt, disabledAt, purgeAfter sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT deleted_at, disabled_at, purge_after FROM users WHERE id = $1`, userID).
+		Scan(&deletedAt, &disabledAt, &purgeAfter)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrAccountNotFound
+	case err != nil:
+		return err
+	case deletedAt.Valid:
+		return ErrAccountDeleted
+	case disabledAt.Valid:
+		return ErrAccountDisabled
+	case purgeAfter.Valid:
+		return ErrAccountDeleting
+	}
+	return nil
+}
+
+// IsAccountStatusError reports whether err came from CheckAccountStatus
+// rejecting the account, as opposed to a database failure.
+func IsAccountStatusError(err error) bool {
+	return errors.Is(err, ErrAccountNotFound) || errors.Is(err, ErrAccountDeleted) ||
+		errors.Is(err, ErrAccountDisabled) || errors.Is(err, ErrAccountDeleting)
+}
+
+func IsAdmin(ctx context.Context, db *sql.DB, userID string) (bool, error) {
+	var role string
+	err := db.QueryRowContext(ctx, `SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return role == "admin", err
+}
@@ -1,11 +1,16 @@
 package middleware
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"rliterate-octo-waddle/server/audit"
+	"rliterate-octo-waddle/server/ids"
+	"rliterate-octo-waddle/server/problem"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,14 +19,24 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// UserClaims identifies the user and the sign-in session a token belongs to.
+// A session starts at login or registration and keeps its ID across
+// refreshes, so each device holds its own pair of tokens.
 type UserClaims struct {
-	ID string `json:"id"`
+	ID        string `json:"id"`
+	SessionID string `json:"sid"`
 	jwt.StandardClaims
 }
 
-func GenerateTokens(userID string) (accessToken, refreshToken string, err error) {
+// NewSessionID returns an ID for a new sign-in session.
+func NewSessionID() (string, error) {
+	return ids.NewV7()
+}
+
+func GenerateTokens(userID, sessionID string) (accessToken, refreshToken string, err error) {
 	accessClaims := UserClaims{
-		ID: userID,
+		ID:        userID,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(15 * time.Minute).Unix(),
 			IssuedAt:  time.Now().Unix(),
@@ -29,7 +44,8 @@ func GenerateTokens(userID string) (accessToken, refreshToken string, err error)
 	}
 
 	refreshClaims := UserClaims{
-		ID: userID,
+		ID:        userID,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(7 * 24 * time.Hour).Unix(),
 			IssuedAt:  time.Now().Unix(),
@@ -87,12 +103,11 @@ func ValidateToken(tokenStr string, isRefresh bool) (*UserClaims, error) {
 	return claims, nil
 }
 
-func JWTMiddleware() gin.HandlerFunc {
+func JWTMiddleware(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
-			c.Abort()
+			problem.AbortCode(c, http.StatusUnauthorized, problem.CodeMissingToken, "Missing Authorization header")
 			return
 		}
 
@@ -100,49 +115,197 @@ func JWTMiddleware() gin.HandlerFunc {
 
 		claims, err := ValidateToken(tokenStr, false)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			audit.Record(db, c, audit.Event{
+				Action:   audit.ActionTokenRejected,
+				Outcome:  audit.OutcomeFailure,
+				Metadata: map[string]any{"reason": "invalid", "path": c.FullPath()},
+			})
+			problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidToken, "Invalid token")
 			return
 		}
 
-		tokens, ok := GetTokens(claims.ID)
+		tokens, ok := GetTokens(claims.ID, claims.SessionID)
 		if !ok || tokens["access"] != tokenStr {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
-			c.Abort()
+			audit.Record(db, c, audit.Event{
+				ActorID:  claims.ID,
+				Action:   audit.ActionTokenRejected,
+				Outcome:  audit.OutcomeFailure,
+				Metadata: map[string]any{"reason": "revoked", "path": c.FullPath()},
+			})
+			problem.AbortCode(c, http.StatusUnauthorized, problem.CodeTokenRevoked, "Token revoked")
+			return
+		}
+
+		if err := CheckAccountStatus(c, db, claims.ID); IsAccountStatusError(err) {
+			audit.Record(db, c, audit.Event{
+				ActorID:  claims.ID,
+				Action:   audit.ActionTokenRejected,
+				Outcome:  audit.OutcomeFailure,
+				Metadata: map[string]any{"reason": err.Error(), "path": c.FullPath()},
+			})
+			problem.AbortCode(c, http.StatusForbidden, problem.CodeAccountUnavailable, "Account unavailable: "+err.Error())
+			return
+		} else if err != nil {
+			fmt.Println("Failed to check account status:", err)
+			problem.Abort(c, http.StatusInternalServerError, "Database error")
 			return
 		}
 
 		c.Set("userID", claims.ID)
+		c.Set("sessionID", claims.SessionID)
 		c.Next()
 	}
 }
 
+// RequireAdmin must run after JWTMiddleware. It looks up the caller's role
+// on every request so that demoting an admin takes effect immediately.
+func RequireAdmin(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userID")
+
+		admin, err := IsAdmin(c, db, userID)
+		if err != nil {
+			fmt.Println("Failed to look up role:", err)
+			problem.Abort(c, http.StatusInternalServerError, "Database error")
+			return
+		}
+
+		if !admin {
+			audit.Record(db, c, audit.Event{
+				ActorID:  userID,
+				Action:   audit.ActionAdminDenied,
+				Outcome:  audit.OutcomeFailure,
+				Metadata: map[string]any{"path": c.FullPath()},
+			})
+			problem.AbortCode(c, http.StatusForbidden, problem.CodeAdminRequired, "Admin access required")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// activeTokens holds the current access and refresh token of every
+// session, by user ID and then session ID.
 var (
-	activeTokens   = make(map[string]map[string]string)
+	activeTokens   = make(map[string]map[string]map[string]string)
 	activeTokensMu sync.Mutex
+
+	revokeHooks []func(userID, sessionID string)
 )
 
-func StoreTokens(userID, access, refresh string) {
+// OnRevoke registers fn to run whenever tokens are revoked, so that
+// long-lived sessions such as websocket connections can be closed too.
+// sessionID is empty when every session of the user was revoked. Hooks
+// should be registered during startup.
+func OnRevoke(fn func(userID, sessionID string)) {
+	revokeHooks = append(revokeHooks, fn)
+}
+
+// StoreTokens records the session's current tokens, replacing any it had.
+// The user's other sessions are left alone.
+func StoreTokens(userID, sessionID, access, refresh string) {
 	activeTokensMu.Lock()
 	defer activeTokensMu.Unlock()
 
-	activeTokens[userID] = map[string]string{
+	sessions, ok := activeTokens[userID]
+	if !ok {
+		sessions = make(map[string]map[string]string)
+		activeTokens[userID] = sessions
+	}
+	sessions[sessionID] = map[string]string{
 		"access":  access,
 		"refresh": refresh,
 	}
 }
 
-func RevokeTokens(userID string) {
+// ReplaceAccessToken swaps in a new access token for the session whose
+// refresh token is refresh. It reports false if there is no such session,
+// e.g. because it was revoked.
+func ReplaceAccessToken(userID, sessionID, refresh, access string) bool {
 	activeTokensMu.Lock()
 	defer activeTokensMu.Unlock()
 
+	tokens, ok := activeTokens[userID][sessionID]
+	if !ok || tokens["refresh"] != refresh {
+		return false
+	}
+	// GetTokens hands out the stored map, so it is replaced, not changed.
+	activeTokens[userID][sessionID] = map[string]string{
+		"access":  access,
+		"refresh": refresh,
+	}
+	return true
+}
+
+// RevokeTokens ends every session of the user.
+func RevokeTokens(userID string) {
+	activeTokensMu.Lock()
 	delete(activeTokens, userID)
+	activeTokensMu.Unlock()
+
+	for _, fn := range revokeHooks {
+		fn(userID, "")
+	}
 }
 
-func GetTokens(userID string) (map[string]string, bool) {
+// RevokeSession ends one session of the user, leaving the others signed in.
+func RevokeSession(userID, sessionID string) {
+	activeTokensMu.Lock()
+	if sessions, ok := activeTokens[userID]; ok {
+		delete(sessions, sessionID)
+		if len(sessions) == 0 {
+			delete(activeTokens, userID)
+		}
+	}
+	activeTokensMu.Unlock()
+
+	for _, fn := range revokeHooks {
+		fn(userID, sessionID)
+	}
+}
+
+func GetTokens(userID, sessionID string) (map[string]string, bool) {
 	activeTokensMu.Lock()
 	defer activeTokensMu.Unlock()
 
-	tokens, ok := activeTokens[userID]
+	tokens, ok := activeTokens[userID][sessionID]
 	return tokens, ok
 }
+
+// Session describes one of a user's active tokens without revealing it.
+type Session struct {
+	Session   string `json:"session"`
+	Token     string `json:"token"`
+	IssuedAt  int64  `json:"issued_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Sessions lists the user's active tokens grouped by session, access first.
+func Sessions(userID string) []Session {
+	activeTokensMu.Lock()
+	var sessionIDs []string
+	tokens := make(map[string]map[string]string)
+	for sessionID, pair := range activeTokens[userID] {
+		sessionIDs = append(sessionIDs, sessionID)
+		tokens[sessionID] = pair
+	}
+	activeTokensMu.Unlock()
+	// Session IDs are UUIDv7s, so sorting them orders sessions roughly by
+	// when they began.
+	sort.Strings(sessionIDs)
+
+	sessions := []Session{}
+	for _, sessionID := range sessionIDs {
+		for _, kind := range []string{"access", "refresh"} {
+			var claims UserClaims
+			// The tokens were issued and stored by this server, so their
+			// signatures need no checking here.
+			if _, _, err := jwt.NewParser().ParseUnverified(tokens[sessionID][kind], &claims); err != nil {
+				continue
+			}
+			sessions = append(sessions, Session{Session: sessionID, Token: kind, IssuedAt: claims.IssuedAt, ExpiresAt: claims.ExpiresAt})
+		}
+	}
+	return sessions
+}
@@ -0,0 +1,320 @@
+// Package problem renders error responses as RFC 7807 application/problem+json
+// documents. Every problem carries a stable code that clients can switch on;
+// the title and detail are for people and may change.
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const ContentType = "application/problem+json"
+
+// Codes shared by many endpoints. Codes not listed here default to the
+// snake-cased status text, e.g. not_found for 404.
+const (
+	CodeInvalidRequest       = "invalid_request"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeConflict             = "conflict"
+	CodeAlreadyExists        = "already_exists"
+	CodePreconditionFailed   = "precondition_failed"
+	CodePreconditionRequired = "precondition_required"
+	CodeInternal             = "internal_error"
+	CodeUnavailable          = "unavailable"
+
+	CodeMissingToken       = "missing_token"
+	CodeInvalidToken       = "invalid_token"
+	CodeTokenRevoked       = "token_revoked"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeAccountUnavailable = "account_unavailable"
+	CodeAccountDisabled    = "account_disabled"
+	CodeDeletionScheduled  = "account_deletion_scheduled"
+	CodeGracePeriodEnded   = "deletion_grace_period_ended"
+	CodeAdminRequired      = "admin_required"
+	CodeInvalidSignature   = "invalid_signature"
+	CodeLinkExpired        = "link_expired"
+	CodeChecksumMismatch   = "checksum_mismatch"
+)
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           CodeInvalidRequest,
+	http.StatusUnprocessableEntity:  CodeValidationFailed,
+	http.StatusInternalServerError:  CodeInternal,
+	http.StatusServiceUnavailable:   CodeUnavailable,
+	http.StatusPreconditionFailed:   CodePreconditionFailed,
+	http.StatusPreconditionRequired: CodePreconditionRequired,
+}
+
+// FieldError explains why one field of a request was rejected. Field is a
+// JSON Pointer into the request document, e.g. /email.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// Problem is an error that knows how it should be reported to the client.
+// Handlers either build one and pass it to AbortWith, or pass any error to
+// AbortError, which maps it with FromError.
+type Problem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+	Code     string
+	Errors   []FieldError
+	// Extensions are extra members such as purge_after, written next to
+	// the standard ones.
+	Extensions map[string]any
+
+	cause error
+}
+
+// New returns a problem for status whose code is derived from the status.
+func New(status int, detail string) *Problem {
+	return &Problem{Status: status, Detail: detail, Code: codeForStatus(status)}
+}
+
+// Validation returns a 422 problem listing the rejected fields.
+func Validation(detail string, fields ...FieldError) *Problem {
+	return New(http.StatusUnprocessableEntity, detail).WithErrors(fields...)
+}
+
+// WithCode replaces the problem's code.
+func (p *Problem) WithCode(code string) *Problem {
+	p.Code = code
+	return p
+}
+
+// WithErrors sets the rejected fields.
+func (p *Problem) WithErrors(fields ...FieldError) *Problem {
+	p.Errors = fields
+	return p
+}
+
+// With adds an extension member.
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = map[string]any{}
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.cause != nil {
+		return p.Detail + ": " + p.cause.Error()
+	}
+	return p.Detail
+}
+
+func (p *Problem) Unwrap() error { return p.cause }
+
+// MarshalJSON writes the RFC 7807 members first, then the extensions.
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	body, err := json.Marshal(struct {
+		Type     string       `json:"type"`
+		Title    string       `json:"title"`
+		Status   int          `json:"status"`
+		Code     string       `json:"code"`
+		Detail   string       `json:"detail,omitempty"`
+		Instance string       `json:"instance,omitempty"`
+		Errors   []FieldError `json:"errors,omitempty"`
+	}{p.Type, p.Title, p.Status, p.Code, p.Detail, p.Instance, p.Errors})
+	if err != nil || len(p.Extensions) == 0 {
+		return body, err
+	}
+	extensions := maps.Clone(p.Extensions)
+	for _, member := range []string{"type", "title", "status", "code", "detail", "instance", "errors"} {
+		delete(extensions, member)
+	}
+	extra, err := json.Marshal(extensions)
+	if err != nil || len(extra) <= 2 {
+		return body, err
+	}
+	return append(append(body[:len(body)-1], ','), extra[1:]...), nil
+}
+
+func codeForStatus(status int) string {
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	text = strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text)
+	return strings.ToLower(text)
+}
+
+// FromError maps err to a problem. Problems are returned as they are and
+// Postgres errors by their SQLSTATE; anything else becomes a 500 whose
+// detail does not reveal err.
+func FromError(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return fromPQ(pqErr)
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		p = New(http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit))
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		p = New(http.StatusServiceUnavailable, "The request took too long, try again")
+	} else {
+		p = New(http.StatusInternalServerError, "Internal server error")
+	}
+	p.cause = err
+	return p
+}
+
+// pqField guesses the column behind a constraint named the Postgres way,
+// <table>_<column>_key.
+func pqField(e *pq.Error) string {
+	if e.Column != "" {
+		return e.Column
+	}
+	name := strings.TrimPrefix(e.Constraint, e.Table+"_")
+	if name == "pkey" {
+		return "id"
+	}
+	for _, suffix := range []string{"_key", "_idx", "_fkey", "_check"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
+
+func fromPQ(e *pq.Error) *Problem {
+	var p *Problem
+	field := pqField(e)
+	switch e.Code {
+	case "23505": // unique_violation
+		p = New(http.StatusConflict, "A record with this "+field+" already exists").WithCode(CodeAlreadyExists)
+		p.Errors = []FieldError{{Field: "/" + field, Code: "taken", Message: "is already taken"}}
+	case "23503": // foreign_key_violation
+		p = New(http.StatusConflict, "The request refers to a record that does not exist or is still in use")
+	case "23502": // not_null_violation
+		p = Validation("A required field is missing", FieldError{Field: "/" + field, Code: "required", Message: "is required"})
+	case "23514": // check_violation
+		p = Validation("A field has an invalid value", FieldError{Field: "/" + field, Code: "invalid", Message: "is invalid"})
+	case "22001": // string_data_right_truncation
+		p = Validation("A field is too long")
+	case "22P02": // invalid_text_representation
+		p = New(http.StatusBadRequest, "A value has the wrong format")
+	case "40001", "40P01": // serialization_failure, deadlock_detected
+		p = New(http.StatusServiceUnavailable, "The request conflicted with another one, try again").With("retry", true)
+	case "57014", "53300": // query_canceled, too_many_connections
+		p = New(http.StatusServiceUnavailable, "The database is busy, try again")
+	default:
+		p = New(http.StatusInternalServerError, "Internal server error")
+	}
+	p.cause = e
+	return p
+}
+
+// AbortWith writes p and stops the handler chain.
+func AbortWith(c *gin.Context, p *Problem) {
+	out := *p
+	if out.Code == "" {
+		out.Code = codeForStatus(out.Status)
+	}
+	if out.Type == "" {
+		out.Type = "/problems/" + out.Code
+	}
+	if out.Title == "" {
+		out.Title = http.StatusText(out.Status)
+	}
+	if out.Title == "" {
+		out.Title = "Error"
+	}
+	if out.Instance == "" && c.Request != nil {
+		out.Instance = c.Request.URL.Path
+	}
+	body, err := json.Marshal(&out)
+	if err != nil {
+		body = []byte(`{"type":"/problems/internal_error","title":"Internal Server Error","status":500,"code":"internal_error"}`)
+		out.Status = http.StatusInternalServerError
+	}
+	c.Abort()
+	c.Data(out.Status, ContentType, body)
+}
+
+// Abort writes a problem with the given status and detail.
+func Abort(c *gin.Context, status int, detail string) {
+	AbortWith(c, New(status, detail))
+}
+
+// AbortCode writes a problem with an explicit code.
+func AbortCode(c *gin.Context, status int, code, detail string) {
+	AbortWith(c, New(status, detail).WithCode(code))
+}
+
+// AbortError writes the problem FromError maps err to.
+func AbortError(c *gin.Context, err error) {
+	AbortWith(c, FromError(err))
+}
+
+// FieldErrors turns a map of field name to message, as built by simple
+// validators, into field errors sorted by field.
+func FieldErrors(fields map[string]string) []FieldError {
+	out := make([]FieldError, 0, len(fields))
+	for field, msg := range fields {
+		if !strings.HasPrefix(field, "/") {
+			field = "/" + field
+		}
+		out = append(out, FieldError{Field: field, Message: msg})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Field < out[j].Field })
+	return out
+}
+
+// Middleware reports errors handlers attached with c.Error, and panics, as
+// problems if nothing has been written yet. The cause is logged; the client
+// only sees what FromError makes of it.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				fmt.Println("Panic serving", c.Request.Method, c.Request.URL.Path+":", v)
+				if !c.Writer.Written() {
+					Abort(c, http.StatusInternalServerError, "Internal server error")
+				}
+			}
+		}()
+		c.Next()
+		if len(c.Errors) > 0 && !c.Writer.Written() {
+			err := c.Errors.Last().Err
+			fmt.Println("Request failed:", c.Request.Method, c.Request.URL.Path, err)
+			AbortError(c, err)
+		}
+	}
+}
+
+// NotFound answers requests that match no route.
+func NotFound(c *gin.Context) {
+	Abort(c, http.StatusNotFound, "No route matches "+c.Request.URL.Path)
+}
+
+// MethodNotAllowed answers requests whose path exists for other methods.
+func MethodNotAllowed(c *gin.Context) {
+	Abort(c, http.StatusMethodNotAllowed, c.Request.Method+" is not allowed on "+c.Request.URL.Path)
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"rliterate-octo-waddle/server/handlers"
+	"rliterate-octo-waddle/server/storage"
+	"time"
+)
+
+const defaultPurgeInterval = time.Hour
+
+// runPurgeJob periodically deletes accounts whose deletion grace period has
+// ended, and resumable uploads and data exports that have expired. The
+// interval is configured with ACCOUNT_PURGE_INTERVAL.
+func runPurgeJob(db *sql.DB, blobs storage.BlobStore) {
+	interval := defaultPurgeInterval
+	if raw := os.Getenv("ACCOUNT_PURGE_INTERVAL"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid ACCOUNT_PURGE_INTERVAL %q, using %s", raw, defaultPurgeInterval)
+		} else {
+			interval = parsed
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := handlers.PurgeDeletedAccounts(db, blobs)
+		if err != nil {
+			log.Println("[PURGE] failed:", err)
+		} else if purged > 0 {
+			log.Printf("[PURGE] removed %d accounts", purged)
+		}
+		expired, err := handlers.ExpireUploads(db, blobs)
+		if err != nil {
+			log.Println("[PURGE] expiring uploads failed:", err)
+		} else if expired > 0 {
+			log.Printf("[PURGE] removed %d expired uploads", expired)
+		}
+		exports, err := handlers.ExpireDataExports(db, blobs)
+		if err != nil {
+			log.Println("[PURGE] expiring data exports failed:", err)
+		} else if exports > 0 {
+			log.Printf("[PURGE] removed %d expired data exports", exports)
+		}
+		<-ticker.C
+	}
+}
@@ -3,11 +3,15 @@ package server
 import (
 	"database/sql"
 	"rliterate-octo-waddle/server/handlers"
+	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
-func addOpenRoutes(r *gin.Engine, db *sql.DB, dbStatus string) {
+func addOpenRoutes(r *gin.Engine, db *sql.DB, blobs storage.BlobStore, dbStatus string) {
+	users := handlers.NewPostgresUserRepository(db)
+
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"api": "[CONNECTED] api is running on nginx proxy http://localhost/",
@@ -15,31 +19,148 @@ func addOpenRoutes(r *gin.Engine, db *sql.DB, dbStatus string) {
 		})
 	})
 	r.POST("auth/login", func(c *gin.Context) {
-		handlers.Login(db, c)
+		handlers.Login(users, c)
 	})
 	r.POST("auth/register", func(c *gin.Context) {
-		handlers.RegisterUser(db, c)
+		handlers.RegisterUser(users, c)
 	})
 	r.GET("auth/refresh", func(c *gin.Context) {
-		handlers.Refresh(c)
+		handlers.Refresh(users, c)
+	})
+	r.POST("auth/logout", middleware.JWTMiddleware(db), func(c *gin.Context) {
+		handlers.Logout(users, c)
+	})
+	r.POST("auth/restore", func(c *gin.Context) {
+		handlers.RestoreAccount(db, c)
+	})
+	r.GET("auth/email/confirm", handlers.ShowConfirmEmailChange)
+	r.POST("auth/email/confirm", func(c *gin.Context) {
+		handlers.ConfirmEmailChange(db, c)
+	})
+	r.GET("auth/email/undo", handlers.ShowUndoEmailChange)
+	r.POST("auth/email/undo", func(c *gin.Context) {
+		handlers.UndoEmailChange(db, c)
 	})
-	r.POST("auth/logout", func(c *gin.Context) {
-		handlers.Logout(c)
+	r.POST("auth/invite/accept", func(c *gin.Context) {
+		handlers.AcceptInvite(db, c)
 	})
+	r.GET("avatars/:id/:avatar", func(c *gin.Context) {
+		handlers.GetAvatar(db, blobs, c)
+	})
+	r.GET("exports/:id/download", func(c *gin.Context) {
+		handlers.DownloadDataExport(db, blobs, c)
+	})
+	r.GET("files/:id/download", func(c *gin.Context) {
+		handlers.DownloadSignedFile(db, blobs, c)
+	})
+	r.OPTIONS("api/files/uploads", handlers.TusOptions)
+	r.OPTIONS("api/files/uploads/:id", handlers.TusOptions)
 }
 
-func addProtectedRoutes(r *gin.RouterGroup, db *sql.DB) {
+func addProtectedRoutes(r *gin.RouterGroup, db *sql.DB, blobs storage.BlobStore) {
+	users := handlers.NewPostgresUserRepository(db)
 
 	r.GET("/users", func(c *gin.Context) {
-		handlers.GetUsers(db, c)
+		handlers.GetUsers(users, c)
+	})
+	r.GET("/users/search", func(c *gin.Context) {
+		handlers.SearchUsers(users, c)
 	})
 	r.GET("/users/:id", func(c *gin.Context) {
-		handlers.GetUserByID(db, c)
+		handlers.GetUserByID(users, c)
 	})
 	r.PUT("/users", func(c *gin.Context) {
-		handlers.UpdateUser(db, c)
+		handlers.UpdateUser(users, c)
+	})
+	r.PATCH("/users/:id", func(c *gin.Context) {
+		handlers.PatchUser(users, c)
+	})
+	r.GET("/users/:id/profile", func(c *gin.Context) {
+		handlers.GetUserProfile(users, c)
+	})
+	r.PUT("/users/:id/profile", func(c *gin.Context) {
+		handlers.PutUserProfile(users, c)
 	})
 	r.DELETE("/users/:id", func(c *gin.Context) {
-		handlers.DeleteUserByID(db, c)
+		handlers.DeleteUserByID(users, c)
+	})
+	r.POST("/users/password", func(c *gin.Context) {
+		handlers.UpdatePassword(users, c)
+	})
+	r.POST("/users/email", func(c *gin.Context) {
+		handlers.RequestEmailChange(db, c)
+	})
+	r.POST("/users/me/deletion", func(c *gin.Context) {
+		handlers.RequestAccountDeletion(db, c)
+	})
+	r.POST("/users/me/exports", func(c *gin.Context) {
+		handlers.RequestDataExport(db, c)
+	})
+	r.GET("/users/me/exports", func(c *gin.Context) {
+		handlers.ListDataExports(db, c)
+	})
+	r.GET("/users/me/exports/:id", func(c *gin.Context) {
+		handlers.GetDataExport(db, c)
+	})
+	r.PUT("/users/me/avatar", func(c *gin.Context) {
+		handlers.UploadAvatar(db, blobs, c)
+	})
+	r.DELETE("/users/me/avatar", func(c *gin.Context) {
+		handlers.DeleteAvatar(db, blobs, c)
+	})
+	r.GET("/users/me/messages/:id", func(c *gin.Context) {
+		handlers.GetConversation(db, c)
+	})
+
+	r.GET("/files", func(c *gin.Context) {
+		handlers.ListFiles(db, c)
+	})
+	r.POST("/files", func(c *gin.Context) {
+		handlers.UploadFile(db, blobs, c)
+	})
+	r.GET("/files/:id", func(c *gin.Context) {
+		handlers.GetFile(db, c)
+	})
+	r.GET("/files/:id/content", func(c *gin.Context) {
+		handlers.DownloadFile(db, blobs, c)
+	})
+	r.POST("/files/:id/url", func(c *gin.Context) {
+		handlers.CreateFileURL(db, c)
+	})
+	r.DELETE("/files/:id", func(c *gin.Context) {
+		handlers.DeleteFile(db, blobs, c)
+	})
+	r.POST("/files/uploads", func(c *gin.Context) {
+		handlers.CreateUpload(db, c)
+	})
+	r.HEAD("/files/uploads/:id", func(c *gin.Context) {
+		handlers.GetUploadOffset(db, c)
+	})
+	r.PATCH("/files/uploads/:id", func(c *gin.Context) {
+		handlers.PatchUpload(db, blobs, c)
+	})
+	r.DELETE("/files/uploads/:id", func(c *gin.Context) {
+		handlers.TerminateUpload(db, blobs, c)
+	})
+
+	admin := r.Group("/admin")
+	admin.Use(middleware.RequireAdmin(db))
+	admin.GET("/audit", func(c *gin.Context) {
+		handlers.GetAuditEvents(db, c)
+	})
+	admin.POST("/users/:id/disable", func(c *gin.Context) {
+		handlers.DisableUser(db, c)
+	})
+	admin.POST("/users/:id/enable", func(c *gin.Context) {
+		handlers.EnableUser(db, c)
+	})
+	admin.POST("/users/:id/restore", func(c *gin.Context) {
+		handlers.RestoreUser(db, c)
+	})
+	admin.POST("/users/import", func(c *gin.Context) {
+		handlers.ImportUsers(db, c)
+	})
+	admin.GET("/users/export", func(c *gin.Context) {
+		handlers.ExportUsers(db, c)
 	})
 }
@@ -1,16 +1,21 @@
 package server
 
 import (
+	"context"
 	"log"
 	"rliterate-octo-waddle/db"
+	"rliterate-octo-waddle/db/migrations"
 	"rliterate-octo-waddle/server/handlers"
 	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
+	"rliterate-octo-waddle/server/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
 func StartAuthenticationServer() {
 	go hub.Run()
+	middleware.OnRevoke(hub.Disconnect)
 
 	// Connect to PostgreSQL
 	postgres, msg := db.ConnectPSQL()
@@ -19,16 +24,41 @@ func StartAuthenticationServer() {
 		log.Fatal("Error connecting to the database:", err)
 	}
 	defer postgres.Close()
-	handlers.CreateUsersTable(postgres)
+	if applied, err := migrations.Up(context.Background(), postgres); err != nil {
+		log.Fatal("Error applying migrations:", err)
+	} else if applied > 0 {
+		log.Printf("[MIGRATED] Applied %d schema migrations", applied)
+	}
+	if migrated, err := handlers.MigrateLegacyUserIDs(postgres); err != nil {
+		log.Fatal("Error migrating legacy user IDs:", err)
+	} else if migrated > 0 {
+		log.Printf("[MIGRATED] Replaced %d legacy user IDs", migrated)
+	}
+
+	blobs, err := storage.FromEnv()
+	if err != nil {
+		log.Fatal("Error configuring file storage:", err)
+	}
+
+	go runPurgeJob(postgres, blobs)
+	go runDataExportJob(postgres, blobs)
 
 	// Set up Gin router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
-	router.GET("/ws", serveWs)
+	// Every error response is application/problem+json, including those for
+	// unknown routes and errors handlers pass to c.Error.
+	router.Use(problem.Middleware())
+	router.HandleMethodNotAllowed = true
+	router.NoRoute(problem.NotFound)
+	router.NoMethod(problem.MethodNotAllowed)
+	router.GET("/ws", func(c *gin.Context) {
+		serveWs(postgres, c)
+	})
 	protected := router.Group("/api")
-	protected.Use(middleware.JWTMiddleware())
-	addOpenRoutes(router, postgres, msg)
-	addProtectedRoutes(protected, postgres)
+	protected.Use(middleware.JWTMiddleware(postgres))
+	addOpenRoutes(router, postgres, blobs, msg)
+	addProtectedRoutes(protected, postgres, blobs)
 	log.Println("[CONNECTED] server listenting on nginx proxy http://localhost/")
 	log.Println(msg)
 	router.Run(":8081")
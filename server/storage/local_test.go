@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readBlob(t *testing.T, body io.ReadCloser, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestLocalStorePutReplaces(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "owner/file"
+	for _, content := range []string{"old contents", "new"} {
+		if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+			t.Fatalf("Put(%q): %v", content, err)
+		}
+	}
+	body, err := store.Get(ctx, key)
+	if got := readBlob(t, body, err); got != "new" {
+		t.Errorf("Get after replace = %q, want %q", got, "new")
+	}
+}
+
+func TestLocalStorePutSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "owner/file", strings.NewReader("short"), 10, "text/plain"); err == nil {
+		t.Fatal("Put with a wrong size succeeded")
+	}
+	if _, err := store.Get(ctx, "owner/file"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after a failed Put = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "../outside", "/etc/passwd", "a/../../outside"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// blobReader reads a blob of known size through ranged gets, so it can be
+// handed to http.ServeContent to answer Range requests on any store.
+type blobReader struct {
+	ctx    context.Context
+	store  BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// NewReader returns a seekable reader over the blob stored under key. The
+// blob is only fetched once reading starts, from the current offset to the
+// end; seeking closes any open fetch.
+func NewReader(ctx context.Context, store BlobStore, key string, size int64) io.ReadSeekCloser {
+	return &blobReader{ctx: ctx, store: store, key: key, size: size}
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.store.GetRange(r.ctx, r.key, r.offset, r.size-r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative seek offset")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return r.offset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore holds file contents by key. Keys are generated by the server
+// and look like <owner id>/<file id>; metadata lives in the files table.
+type BlobStore interface {
+	// Put stores size bytes read from body under key, replacing any blob
+	// already there.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get returns the blob's contents; the caller must close them.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange returns length bytes of the blob starting at offset.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns the blob's size, or ErrNotFound if there is no blob.
+	Stat(ctx context.Context, key string) (int64, error)
+	// Delete removes the blob. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// FromEnv builds the store selected by STORAGE_BACKEND: "local" (default)
+// keeps blobs under STORAGE_DIR, "s3" uses an S3-compatible service
+// configured by the S3_* variables.
+func FromEnv() (BlobStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "data/files"
+		}
+		return NewLocalStore(dir)
+	case "s3":
+		return NewS3Store(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q, expected local or s3", backend)
+	}
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"rliterate-octo-waddle/server/ids"
 	"rliterate-octo-waddle/server/middleware"
+	"rliterate-octo-waddle/server/problem"
 	"sync"
 	"time"
 
@@ -11,53 +16,97 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// maxMessageBytes bounds a single frame read from a client.
+const maxMessageBytes = 64 << 10
+
+// Client is one websocket connection. ID is the user's ID, shared by all of
+// their connections; ConnID tells the connections apart. SessionID is the
+// sign-in session whose token opened the connection.
 type Client struct {
-	ID   string
-	Conn *websocket.Conn
-	Send chan []byte
+	ID        string
+	ConnID    string
+	SessionID string
+	Protocol  string
+	Conn      *websocket.Conn
+	Send      chan []byte
+
+	// channels the client has joined, guarded by hub.mu.
+	channels map[string]struct{}
 }
 
+// Hub tracks connections by user ID and then connection ID, so each tab or
+// device a user opens gets its own entry.
 type Hub struct {
-	clients    map[string]*Client
-	register   chan *Client
+	clients    map[string]map[string]*Client
+	channels   map[string]map[*Client]struct{}
+	register   chan registration
 	unregister chan *Client
-	broadcast  chan []byte
+	broadcast  chan Envelope
 	mu         sync.RWMutex
 }
 
 var hub = Hub{
-	clients:    make(map[string]*Client),
-	register:   make(chan *Client),
+	clients:    make(map[string]map[string]*Client),
+	channels:   make(map[string]map[*Client]struct{}),
+	register:   make(chan registration),
 	unregister: make(chan *Client),
-	broadcast:  make(chan []byte),
+	broadcast:  make(chan Envelope),
+}
+
+// registration asks Run to add client; done is closed once it is in
+// h.clients.
+type registration struct {
+	client *Client
+	done   chan struct{}
 }
 
 func (h *Hub) Run() {
 	for {
 		select {
-		case client := <-h.register:
+		case reg := <-h.register:
+			client := reg.client
 			h.mu.Lock()
-			h.clients[client.ID] = client
+			conns, ok := h.clients[client.ID]
+			if !ok {
+				conns = make(map[string]*Client)
+				h.clients[client.ID] = conns
+			}
+			conns[client.ConnID] = client
 			h.mu.Unlock()
-			log.Printf("Client connected: %s", client.ID)
+			close(reg.done)
+			log.Printf("Client connected: %s (connection %s, %d open)", client.ID, client.ConnID, len(conns))
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.ID]; ok {
+			for channel := range client.channels {
+				h.leave(client, channel)
+			}
+			if conns := h.clients[client.ID]; conns[client.ConnID] == client {
 				close(client.Send)
-				delete(h.clients, client.ID)
-				log.Printf("Client disconnected: %s", client.ID)
+				delete(conns, client.ConnID)
+				if len(conns) == 0 {
+					delete(h.clients, client.ID)
+				}
+				log.Printf("Client disconnected: %s (connection %s)", client.ID, client.ConnID)
 			}
 			h.mu.Unlock()
 
-		case message := <-h.broadcast:
+		case env := <-h.broadcast:
+			frame, err := encodeEnvelope(env)
+			if err != nil {
+				log.Printf("websocket: failed to encode %s message: %v", env.Type, err)
+				continue
+			}
+			// Slow clients are closed rather than dropped here; their read
+			// pump unregisters them.
 			h.mu.RLock()
-			for _, client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client.ID)
+			for _, conns := range h.clients {
+				for _, client := range conns {
+					select {
+					case client.Send <- frame:
+					default:
+						client.Conn.Close()
+					}
 				}
 			}
 			h.mu.RUnlock()
@@ -65,32 +114,88 @@ func (h *Hub) Run() {
 	}
 }
 
-func (h *Hub) Broadcast(message []byte) {
-	h.broadcast <- message
+// Disconnect closes the user's connections opened by the session, or all
+// of them if sessionID is empty. Each read pump then sees the error and
+// unregisters its client as usual.
+func (h *Hub) Disconnect(userID, sessionID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, client := range h.clients[userID] {
+		if sessionID == "" || client.SessionID == sessionID {
+			client.Conn.Close()
+		}
+	}
 }
 
-func (h *Hub) SendTo(clientID string, message []byte) {
+func (h *Hub) Broadcast(env Envelope) {
+	h.broadcast <- env
+}
+
+// SendTo delivers env to every connection of the user and returns how many
+// there were.
+func (h *Hub) SendTo(userID string, env Envelope) int {
+	return h.sendToUser(userID, env, nil)
+}
+
+// sendToUser is SendTo leaving out skip, which may be nil.
+func (h *Hub) sendToUser(userID string, env Envelope, skip *Client) int {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	if client, ok := h.clients[clientID]; ok {
-		client.Send <- message
+	conns := make([]*Client, 0, len(h.clients[userID]))
+	for _, client := range h.clients[userID] {
+		if client != skip {
+			conns = append(conns, client)
+		}
+	}
+	h.mu.RUnlock()
+	for _, client := range conns {
+		client.send(env)
 	}
+	return len(conns)
 }
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: wsProtocols,
 }
 
-func serveWs(c *gin.Context) {
+func serveWs(db *sql.DB, c *gin.Context) {
 	tokenString := c.Query("token") // pass JWT in query string for simplicity
 	if tokenString == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeMissingToken, "missing token")
 		return
 	}
 
 	claims, err := middleware.ValidateToken(tokenString, false)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeInvalidToken, "invalid token")
+		return
+	}
+
+	tokens, ok := middleware.GetTokens(claims.ID, claims.SessionID)
+	if !ok || tokens["access"] != tokenString {
+		problem.AbortCode(c, http.StatusUnauthorized, problem.CodeTokenRevoked, "token revoked")
+		return
+	}
+
+	if err := middleware.CheckAccountStatus(c, db, claims.ID); middleware.IsAccountStatusError(err) {
+		problem.AbortCode(c, http.StatusForbidden, problem.CodeAccountUnavailable, "account unavailable: "+err.Error())
+		return
+	} else if err != nil {
+		fmt.Println("Failed to check account status:", err)
+		problem.Abort(c, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	protocol, ok := negotiateProtocol(c.Request)
+	if !ok {
+		problem.AbortWith(c, problem.New(http.StatusBadRequest, "none of the requested subprotocols is supported").
+			WithCode("unsupported_protocol").With("supported", wsProtocols))
+		return
+	}
+
+	connID, err := ids.NewV7()
+	if err != nil {
+		problem.AbortError(c, err)
 		return
 	}
 
@@ -99,31 +204,50 @@ func serveWs(c *gin.Context) {
 		log.Println("WebSocket upgrade error:", err)
 		return
 	}
+	conn.SetReadLimit(maxMessageBytes)
 
 	client := &Client{
-		ID:   claims.ID,
-		Conn: conn,
-		Send: make(chan []byte, 256),
+		ID:        claims.ID,
+		ConnID:    connID,
+		SessionID: claims.SessionID,
+		Protocol:  protocol,
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+		channels:  make(map[string]struct{}),
 	}
 
-	hub.register <- client
+	// The welcome is queued before registering, so it is always the first
+	// message the client sees.
+	welcome, _ := json.Marshal(map[string]any{"protocol": protocol, "user_id": client.ID, "connection_id": connID})
+	if frame, err := encodeEnvelope(Envelope{Type: MessageWelcome, Payload: welcome}); err == nil {
+		client.Send <- frame
+	}
+	// Wait until the hub has the client, or messages dispatched by the read
+	// pump could find it missing, e.g. when checking it is still connected.
+	registered := make(chan struct{})
+	hub.register <- registration{client: client, done: registered}
+	<-registered
 
 	go client.writePump()
-	go client.readPump()
+	go client.readPump(db)
 }
 
-func (c *Client) readPump() {
+func (c *Client) readPump(db *sql.DB) {
 	defer func() {
 		hub.unregister <- c
 		c.Conn.Close()
 	}()
 	for {
-		_, message, err := c.Conn.ReadMessage()
+		kind, frame, err := c.Conn.ReadMessage()
 		if err != nil {
 			log.Println("read error:", err)
 			break
 		}
-		log.Printf("recv from %s: %s", c.ID, string(message))
+		if kind != websocket.TextMessage {
+			c.sendError("", &ProtocolError{Code: CodeInvalidMessage, Message: "frames must be JSON text"})
+			continue
+		}
+		c.dispatch(db, frame)
 	}
 }
 
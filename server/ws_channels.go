@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"rliterate-octo-waddle/server/middleware"
+	"time"
+)
+
+// Channel names are <kind>:<name>. The kind picks the authorizer deciding
+// who may subscribe and publish.
+var channelName = regexp.MustCompile(`^([a-z]+):([A-Za-z0-9_.-]{1,64})$`)
+
+// maxChannelsPerClient bounds how many channels one connection may join.
+const maxChannelsPerClient = 100
+
+// Message types for channels.
+const (
+	MessageSubscribe   = "subscribe"
+	MessageUnsubscribe = "unsubscribe"
+	MessagePublish     = "publish"
+	MessageChannel     = "message"
+)
+
+// Codes carried by channel errors.
+const (
+	CodeInvalidChannel  = "invalid_channel"
+	CodeForbidden       = "forbidden"
+	CodeNotSubscribed   = "not_subscribed"
+	CodeTooManyChannels = "too_many_channels"
+)
+
+// ChannelAuthorizer decides whether the client may join the channel named
+// name within its kind. Returning a *ProtocolError tells the client why;
+// other errors are reported as internal_error.
+type ChannelAuthorizer func(db *sql.DB, c *Client, name string) error
+
+// channelAuthorizers maps channel kinds to their authorizer. Kinds that are
+// not listed cannot be joined.
+var channelAuthorizers = map[string]ChannelAuthorizer{
+	// Anyone connected may join public channels.
+	"public": func(db *sql.DB, c *Client, name string) error { return nil },
+	// user:<id> reaches every connection of one user, and only them.
+	"user": func(db *sql.DB, c *Client, name string) error {
+		if name != c.ID {
+			return &ProtocolError{Code: CodeForbidden, Message: "user channels are private to their user"}
+		}
+		return nil
+	},
+	"admin": func(db *sql.DB, c *Client, name string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		admin, err := middleware.IsAdmin(ctx, db, c.ID)
+		if err != nil {
+			return err
+		}
+		if !admin {
+			return &ProtocolError{Code: CodeForbidden, Message: "admin channels need the admin role"}
+		}
+		return nil
+	},
+}
+
+// authorizeChannel validates the channel name and runs its authorizer.
+func authorizeChannel(db *sql.DB, c *Client, channel string) error {
+	match := channelName.FindStringSubmatch(channel)
+	if match == nil {
+		return &ProtocolError{Code: CodeInvalidChannel, Message: "channel must look like kind:name"}
+	}
+	authorize, ok := channelAuthorizers[match[1]]
+	if !ok {
+		return &ProtocolError{Code: CodeInvalidChannel, Message: fmt.Sprintf("unknown channel kind %q", match[1])}
+	}
+	return authorize(db, c, match[2])
+}
+
+// Subscribe adds the client to a channel, creating the channel if it has
+// no members yet.
+func (h *Hub) Subscribe(c *Client, channel string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := c.channels[channel]; ok {
+		return nil
+	}
+	if len(c.channels) >= maxChannelsPerClient {
+		return &ProtocolError{Code: CodeTooManyChannels, Message: fmt.Sprintf("at most %d channels per connection", maxChannelsPerClient)}
+	}
+	members, ok := h.channels[channel]
+	if !ok {
+		members = make(map[*Client]struct{})
+		h.channels[channel] = members
+	}
+	members[c] = struct{}{}
+	c.channels[channel] = struct{}{}
+	return nil
+}
+
+// Unsubscribe removes the client from a channel. The channel is dropped
+// once its last member has left. It reports whether the client was a member.
+func (h *Hub) Unsubscribe(c *Client, channel string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.leave(c, channel)
+}
+
+// leave must be called with h.mu held for writing.
+func (h *Hub) leave(c *Client, channel string) bool {
+	if _, ok := c.channels[channel]; !ok {
+		return false
+	}
+	delete(c.channels, channel)
+	members := h.channels[channel]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.channels, channel)
+	}
+	return true
+}
+
+// Publish sends env to every member of the channel except skip, which may
+// be nil. It returns the number of connections the message was queued for.
+func (h *Hub) Publish(channel string, env Envelope, skip *Client) int {
+	env.Channel = channel
+	frame, err := encodeEnvelope(env)
+	if err != nil {
+		log.Printf("websocket: failed to encode %s message: %v", env.Type, err)
+		return 0
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sent := 0
+	for member := range h.channels[channel] {
+		if member == skip {
+			continue
+		}
+		select {
+		case member.Send <- frame:
+			sent++
+		default:
+			member.Conn.Close()
+		}
+	}
+	return sent
+}
+
+func handleSubscribe(db *sql.DB, c *Client, msg Envelope) (any, error) {
+	if err := authorizeChannel(db, c, msg.Channel); err != nil {
+		return nil, err
+	}
+	if err := hub.Subscribe(c, msg.Channel); err != nil {
+		return nil, err
+	}
+	return map[string]any{"channel": msg.Channel}, nil
+}
+
+func handleUnsubscribe(db *sql.DB, c *Client, msg Envelope) (any, error) {
+	if !hub.Unsubscribe(c, msg.Channel) {
+		return nil, &ProtocolError{Code: CodeNotSubscribed, Message: "not subscribed to " + msg.Channel}
+	}
+	return map[string]any{"channel": msg.Channel}, nil
+}
+
+// handlePublish fans the payload out to the other members of a channel the
+// client has joined, as a message naming the sender.
+func handlePublish(db *sql.DB, c *Client, msg Envelope) (any, error) {
+	hub.mu.RLock()
+	_, member := c.channels[msg.Channel]
+	hub.mu.RUnlock()
+	if !member {
+		return nil, &ProtocolError{Code: CodeNotSubscribed, Message: "subscribe to " + msg.Channel + " before publishing"}
+	}
+	if len(msg.Payload) == 0 {
+		return nil, &ProtocolError{Code: CodeInvalidMessage, Message: "publish needs a payload"}
+	}
+	delivered := hub.Publish(msg.Channel, Envelope{Type: MessageChannel, From: c.ID, Payload: msg.Payload}, c)
+	return map[string]any{"channel": msg.Channel, "delivered": delivered}, nil
+}
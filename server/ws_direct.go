@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"rliterate-octo-waddle/server/handlers"
+	"time"
+)
+
+// MessageDirect is both the type clients send a direct message with and the
+// type it is delivered as.
+const MessageDirect = "dm"
+
+// handleDirectMessage stores a direct message, then delivers it to every
+// live connection of the recipient and to the sender's other connections,
+// so all of their devices stay in step. Offline recipients read it from the
+// conversation history endpoint.
+func handleDirectMessage(db *sql.DB, c *Client, msg Envelope) (any, error) {
+	var req handlers.DirectMessageRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		return nil, &ProtocolError{Code: CodeInvalidMessage, Message: "dm payload must be an object with to and body"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := handlers.SendDirectMessage(ctx, db, c.ID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	env := Envelope{Type: MessageDirect, From: c.ID, Payload: payload}
+	delivered := hub.sendToUser(m.RecipientID, env, nil)
+	hub.sendToUser(c.ID, env, c)
+	return map[string]any{"message": m, "delivered": delivered}, nil
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"rliterate-octo-waddle/server/problem"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Subprotocols the websocket endpoint speaks, newest first. Clients ask for
+// one in Sec-WebSocket-Protocol; clients that ask for none get the newest.
+var wsProtocols = []string{"octo-waddle.v1"}
+
+// Envelope is every websocket frame in both directions. ID is chosen by the
+// client and echoed on the ack or error answering its message; From and
+// Timestamp are set by the server, the latter in Unix milliseconds.
+type Envelope struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"`
+	Channel   string          `json:"channel,omitempty"`
+	From      string          `json:"from,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// Message types the server sends on its own account.
+const (
+	MessageWelcome = "welcome"
+	MessageAck     = "ack"
+	MessageError   = "error"
+)
+
+// ProtocolError is an error a message handler reports to the client, as is
+// a client error *problem.Problem. Any other error is logged and reported as
+// internal_error.
+type ProtocolError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message"`
+	Errors  []problem.FieldError `json:"errors,omitempty"`
+}
+
+func (e *ProtocolError) Error() string { return e.Code + ": " + e.Message }
+
+// Codes carried by error messages.
+const (
+	CodeInvalidMessage = "invalid_message"
+	CodeUnknownType    = "unknown_type"
+	CodeInternal       = "internal_error"
+)
+
+// MessageHandler handles one message type. A non-nil result is sent back as
+// the payload of an ack; acks are only sent for messages with an ID.
+type MessageHandler func(db *sql.DB, c *Client, msg Envelope) (any, error)
+
+// messageHandlers is the registry of message types clients may send.
+var messageHandlers = map[string]MessageHandler{
+	"ping":             handlePing,
+	MessageSubscribe:   handleSubscribe,
+	MessageUnsubscribe: handleUnsubscribe,
+	MessagePublish:     handlePublish,
+	MessageDirect:      handleDirectMessage,
+}
+
+// handlePing answers with the server clock, which clients can use to
+// correct the timestamps of messages they receive.
+func handlePing(db *sql.DB, c *Client, msg Envelope) (any, error) {
+	return map[string]any{"server_time": time.Now().UnixMilli()}, nil
+}
+
+// negotiateProtocol picks the subprotocol for a handshake. ok is false when
+// the client only offered protocols the server does not speak.
+func negotiateProtocol(r *http.Request) (protocol string, ok bool) {
+	var offered []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(header, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				offered = append(offered, p)
+			}
+		}
+	}
+	if len(offered) == 0 {
+		return wsProtocols[0], true
+	}
+	for _, p := range wsProtocols {
+		if slices.Contains(offered, p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// dispatch decodes a frame, runs its handler and answers with an ack or an
+// error correlated by the message ID.
+func (c *Client) dispatch(db *sql.DB, frame []byte) {
+	var msg Envelope
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		c.sendError("", &ProtocolError{Code: CodeInvalidMessage, Message: "frame is not a JSON envelope"})
+		return
+	}
+	if msg.Type == "" {
+		c.sendError(msg.ID, &ProtocolError{Code: CodeInvalidMessage, Message: "type is required"})
+		return
+	}
+	handler, ok := messageHandlers[msg.Type]
+	if !ok {
+		c.sendError(msg.ID, &ProtocolError{Code: CodeUnknownType, Message: "unknown message type " + msg.Type})
+		return
+	}
+
+	result, err := handler(db, c, msg)
+	if err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+	if msg.ID != "" {
+		c.Reply(msg.ID, MessageAck, result)
+	}
+}
+
+func (c *Client) sendError(id string, err error) {
+	var protocolErr *ProtocolError
+	var p *problem.Problem
+	if errors.As(err, &p) && p.Status < http.StatusInternalServerError {
+		protocolErr = &ProtocolError{Code: p.Code, Message: p.Detail, Errors: p.Errors}
+	} else if !errors.As(err, &protocolErr) {
+		log.Printf("websocket handler failed for %s: %v", c.ID, err)
+		protocolErr = &ProtocolError{Code: CodeInternal, Message: "internal server error"}
+	}
+	c.Reply(id, MessageError, protocolErr)
+}
+
+// Reply sends a message of the given type with payload to this connection.
+func (c *Client) Reply(id, msgType string, payload any) {
+	env := Envelope{Type: msgType, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("websocket: failed to encode %s payload: %v", msgType, err)
+			return
+		}
+		env.Payload = raw
+	}
+	c.send(env)
+}
+
+// send stamps and queues an envelope for the write pump. It never blocks; a
+// client too slow to keep up is disconnected.
+func (c *Client) send(env Envelope) {
+	frame, err := encodeEnvelope(env)
+	if err != nil {
+		log.Printf("websocket: failed to encode %s message: %v", env.Type, err)
+		return
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if hub.clients[c.ID][c.ConnID] != c {
+		return
+	}
+	select {
+	case c.Send <- frame:
+	default:
+		log.Printf("websocket: send buffer full, disconnecting %s", c.ID)
+		c.Conn.Close()
+	}
+}
+
+func encodeEnvelope(env Envelope) ([]byte, error) {
+	if env.Timestamp == 0 {
+		env.Timestamp = time.Now().UnixMilli()
+	}
+	return json.Marshal(env)
+}
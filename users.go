@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"rliterate-octo-waddle/db"
+	"rliterate-octo-waddle/server/handlers"
+	"strings"
+)
+
+const usersUsage = "usage: users import [-dry-run] [-invite] [-format csv|ndjson] FILE|- | export [-format csv|ndjson] [-include-deleted] [FILE|-]"
+
+// runUsers implements the users subcommand:
+//
+//	users import FILE   create users from a CSV or NDJSON file ("-" for stdin)
+//	users export [FILE] write all users as CSV or NDJSON (default stdout)
+//
+// The format is taken from -format, or else from the file extension.
+func runUsers(args []string) {
+	if len(args) == 0 {
+		log.Fatal(usersUsage)
+	}
+
+	flags := flag.NewFlagSet("users "+args[0], flag.ExitOnError)
+	format := flags.String("format", "", "csv or ndjson")
+	var dryRun, invite, withDeleted *bool
+	switch args[0] {
+	case "import":
+		dryRun = flags.Bool("dry-run", false, "validate and report without creating users")
+		invite = flags.Bool("invite", false, "email an invite to rows without a password")
+	case "export":
+		withDeleted = flags.Bool("include-deleted", false, "include soft-deleted users")
+	default:
+		log.Fatal(usersUsage)
+	}
+	flags.Parse(args[1:])
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = formatFromPath(path)
+	}
+
+	postgres, msg := db.ConnectPSQL()
+	if postgres == nil {
+		log.Fatal(msg)
+	}
+	defer postgres.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "import":
+		if path == "" {
+			log.Fatal(usersUsage)
+		}
+		var in io.Reader = os.Stdin
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		report, err := handlers.RunUserImport(ctx, postgres, in, handlers.ImportOptions{
+			Format:  *format,
+			DryRun:  *dryRun,
+			Invite:  *invite,
+			ActorID: "cli",
+		})
+		if err != nil {
+			log.Fatal("Error importing users: ", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	case "export":
+		var out io.Writer = os.Stdout
+		if path != "" && path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+		err := handlers.WriteUserExport(ctx, postgres, w, handlers.ExportOptions{Format: *format, WithDeleted: *withDeleted})
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Fatal("Error exporting users: ", err)
+		}
+	}
+}
+
+// formatFromPath guesses the format from a file extension, defaulting to
+// CSV.
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return handlers.FormatNDJSON
+	}
+	return handlers.FormatCSV
+}